@@ -6,4 +6,5 @@ require (
 	github.com/gholt/blackfridaytext v0.0.0-20190816214545-16f7b9b9742e
 	github.com/gholt/brimtext v0.0.0-20190811231012-1fbdf4665642
 	github.com/mattn/go-isatty v0.0.12
+	golang.org/x/crypto v0.0.0-20190701094942-4def268fd1a4
 )
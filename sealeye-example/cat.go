@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -45,50 +46,68 @@ type catCLI struct {
 	Secret bool `option:"secret" help:"Deprecated option." hidden:"true"`
 	// Delay shows that time.Duration is a valid option type.
 	Delay time.Duration `option:"delay" help:"Delay between files output. Use durations like \"10s\" or \"5m\"." default:"1s"`
+	// Files shows a positional argument; arg:"rest" takes all the
+	// remaining arguments and required:"set" means at least one must be
+	// given. Single arguments would be arg:"0", arg:"1", and so on, and can
+	// be of any type an option can be.
+	Files []string `arg:"rest" name:"filename" help:"The file or files to output." required:"set"`
+
+	// Debug has no option tag, so it isn't an option of cat itself; instead,
+	// since it has the same name and type as the root's persistent Debug
+	// option, it will be kept set to that option's value.
+	Debug bool
+
+	// Aliases lists other names the subcommand may be called by, such as
+	// "sealeye-example type"; they are shown beside its name in the help
+	// output.
+	Aliases []string
+
+	// Func overrides the one from commonStruct to take a context as well,
+	// which is canceled if the user hits Ctrl-C, and to return an error
+	// rather than an exit code. A returned error is output to stderr and the
+	// exit code will be sealeye.ExitFailure, unless it was made with
+	// sealeye.Exit to give a different code.
+	Func func(ctx context.Context, cli *catCLI) error
 }
 
 func init() {
 	root.Subcommands["cat"] = cat
+	cat.Aliases = []string{"type"}
 	cat.Help = `
-Usage: {{.Command}} [options] filename [filename] ...
-
 This example program will just output the content of the filename or filenames.
 `
 	cat.QuickHelp = "Output the content of a file or files."
-	cat.Func = func(cliI interface{}) int {
-		cli := cliI.(*catCLI)
+	cat.Func = func(ctx context.Context, cli *catCLI) error {
 		// This is here because we overrode the embedded sprinkles option, but
 		// we still want to use it's reusable method, sprinkle().
 		cli.sprinkleOptions.SprinkleType = cli.SprinkleType
-		if len(cli.Args) == 0 {
-			return 1
-		}
 		if cli.HeaderFile != "" {
 			f, err := os.Open(cli.HeaderFile)
 			if err != nil {
-				fmt.Fprintln(os.Stderr, err)
-				return 2
+				return err
 			}
 			if _, err := io.Copy(os.Stdout, f); err != nil {
 				_ = f.Close()
-				fmt.Fprintln(os.Stderr, err)
-				return 2
+				return err
 			}
 			if err := f.Close(); err != nil {
-				fmt.Fprintln(os.Stderr, err)
-				return 2
+				return err
 			}
 		}
 		cli.sprinkle()
-		if cli.Parent.(*rootCLI).Debug {
-			fmt.Printf("We have %d files to output\n", len(cli.Args))
+		if cli.Debug {
+			fmt.Printf("We have %d files to output\n", len(cli.Files))
 		}
 		first := true
-		for _, arg := range cli.Args {
+		for _, arg := range cli.Files {
 			if first {
 				first = false
 			} else {
-				time.Sleep(cli.Delay)
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(cli.Delay):
+				}
 			}
 			if cli.Filenames != nil && *cli.Filenames {
 				fmt.Print(cli.Prefix)
@@ -97,21 +116,18 @@ This example program will just output the content of the filename or filenames.
 			for i := 0; i < cli.Count; i++ {
 				f, err := os.Open(arg)
 				if err != nil {
-					fmt.Fprintln(os.Stderr, err)
-					return 2
+					return err
 				}
 				if _, err := io.Copy(os.Stdout, f); err != nil {
 					_ = f.Close()
-					fmt.Fprintln(os.Stderr, err)
-					return 2
+					return err
 				}
 				if err := f.Close(); err != nil {
-					fmt.Fprintln(os.Stderr, err)
-					return 2
+					return err
 				}
 			}
 		}
 		cli.sprinkle()
-		return 0
+		return nil
 	}
 }
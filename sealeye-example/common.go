@@ -11,7 +11,6 @@ type commonStruct struct {
 	// the parent's list of subcommands.
 	QuickHelp  string
 	Func       func(cli interface{}) int
-	Args       []string
 	HelpOption bool `option:"?,h,help" help:"Outputs this help text."`
 	// Parent will be set to the parent's command struct value, so you can
 	// reference global options, for example. You can omit this field if you
@@ -20,17 +20,39 @@ type rootCLI struct {
 	// "sealeye-example --help". Any instances of {{.Command}} will be replaced
 	// with the name of the calling executable, e.g. "sealeye-example" or, if a
 	// subcommand, the executable plus the subcommand name, e.g.
-	// "sealeye-example cat".
+	// "sealeye-example cat". Similarly, {{.Usage}} will be replaced with a
+	// usage line generated from the options, arguments, and subcommands, e.g.
+	// "sealeye-example cat [options] filename...". If the help text doesn't
+	// have a "Usage:" line, one will be added automatically; see cat.go for
+	// an example.
 	Help string
 
 	// Func is called when all command line parsing succeeds and the command
 	// should actually be run. The integer returned should follow the Unix
-	// convention, 0 for "good", "1" for help text requested, and anything else
-	// for "bad" or "other". Of course, you can always os.Exit(n) yourself too.
+	// convention, sealeye.ExitOK for "good", sealeye.ExitFailure to also
+	// output the help text, and anything else for "bad" or "other". Of
+	// course, you can always os.Exit(n) yourself too.
+	//
+	// Func may also take a context.Context first, which will be canceled if
+	// the user hits Ctrl-C, and may return an error instead of an int. A
+	// returned error is output to stderr, except for sealeye.ErrShowHelp
+	// which outputs the help text instead; see cat.go for an example.
 	Func func(cli *rootCLI) int
 
-	// Args is where the remaining arguments from the command line will reside.
-	Args []string
+	// PersistentBefore is called before Func, for this command and any of
+	// its subcommands, and is a good place for setup like logging. Returning
+	// anything other than sealeye.ExitOK stops things right there, with that
+	// exit code. There is also PersistentAfter, which is called afterward
+	// even if Func panics, and Before and After which are only called around
+	// this command's own Func. Hooks are called in order from the top-level
+	// command down, and the After hooks in the reverse order.
+	PersistentBefore func(cli *rootCLI) int
+
+	// AllowAbbreviations, when true, lets users give any unique prefix of a
+	// long option or subcommand name, e.g. "--ver" for "--version" or "ca"
+	// for "cat". Subcommands with a Parent field use their parent's setting
+	// unless they have their own AllowAbbreviations field.
+	AllowAbbreviations bool
 
 	// Now we list the options available. Each option has an "option" tag,
 	// which can be one or more comma separated option names, and a "help" tag.
@@ -58,6 +80,56 @@ type rootCLI struct {
 	// is no flipside for short options.
 	Color bool `option:"color" help:"Controls color output; use --no-color to disable." default:"terminal"`
 
+	// ConfigOption names a JSON or INI file to take option values from, and
+	// is handled automatically by sealeye. Values from the file are used
+	// before any other defaults, unless an option's default tag places a
+	// "config:" entry elsewhere, as in default:"env:COUNT,config:,1". Keys
+	// are the option names without dashes; values for subcommands go in a
+	// nested object in JSON, such as {"debug": true, "cat": {"count": 2}},
+	// or a section in INI, such as [cat]. Since it is persistent, it also
+	// applies to the subcommands, which will use their own sections, and it
+	// may be given before or after the subcommand name.
+	ConfigOption string `option:"config" help:"A JSON or INI file to read option values from." default:"env:SEALEYE_EXAMPLE_CONFIG" persistent:"true"`
+
+	// ProfileOption names a profile to use from the config files, and is
+	// also handled automatically by sealeye. A profile's values take
+	// precedence over the rest of the config file, and go in a nested object
+	// in JSON, such as {"profiles": {"staging": {"count": 2}}}, or a section
+	// in INI, such as [profiles.staging], with [profiles.staging.cat] for
+	// the cat subcommand. A profile may have an "inherit" key naming another
+	// profile to take any values it doesn't have from. The active profile
+	// is shown in the help output.
+	ProfileOption string `option:"profile" help:"The config file profile to use." default:"env:SEALEYE_EXAMPLE_PROFILE" persistent:"true"`
+
+	// ConfigName, if set, has sealeye look for config files on its own:
+	// .sealeye-example.json (or .ini) in the current directory or the
+	// nearest parent directory that has one, config.json (or .ini) in
+	// $XDG_CONFIG_HOME/sealeye-example, and the same in
+	// /etc/sealeye-example. Values are taken from the first of those that
+	// has them, with the --config file, if any, taking precedence over all.
+	// Relative paths given in a config file for options with required:"file"
+	// and the like are relative to that config file's directory.
+	ConfigName string
+
+	// ExplainOption, when given, has sealeye output a table of every option's
+	// value and where it came from, such as "command line argument 2",
+	// "$DEBUG", "default", or a config file line, instead of running the
+	// command. Since it is persistent, "sealeye-example cat
+	// --explain-options" explains the cat subcommand's options. A Func can
+	// also find out where a single option came from with
+	// sealeye.Source(cli, "Debug").
+	ExplainOption bool `option:"explain-options" help:"Outputs each option's value and where it came from, and exits." persistent:"true"`
+
+	// DumpConfigOption, when given, has sealeye output the effective option
+	// values as a config file instead of running the command, so
+	// "sealeye-example cat --count 2 --dump-config > cat.json" captures
+	// them for use with --config later. Subcommands' options go in their own
+	// nested objects, as described for ConfigOption above. Options tagged
+	// hidden:"true" or secret:"true", such as a password, are left out. As a
+	// bool it outputs JSON; as a string, it may instead name the format,
+	// "json" or "ini".
+	DumpConfigOption bool `option:"dump-config" help:"Outputs the option values as a JSON config file, and exits." persistent:"true"`
+
 	// Version is the first non-sealeye option, which we will handle inside our
 	// Func ourselves.
 	Version bool `option:"V,version" help:"Output version information."`
@@ -65,17 +137,28 @@ type rootCLI struct {
 	// Quick example showing an environment variable default, "env:DEBUG",
 	// which means that if DEBUG=true in the operating system environment, this
 	// option will default to true as well.
-	Debug bool `option:"v,debug" help:"Output debug information." default:"env:DEBUG"`
+	//
+	// It is also marked persistent, so it may be given anywhere on the
+	// command line, even after a subcommand name, as in
+	// "sealeye-example cat --debug filename". Subcommands list it under
+	// "Global options" in their help output; see cat.go for how to read it.
+	Debug bool `option:"v,debug" help:"Output debug information." default:"env:DEBUG" persistent:"true"`
 
 	// And lastly we can have a list of subcommands available. Usually you add
 	// a subcommand in a separate file inside an init() function; see cat.go
 	// and version.go for examples.
+	//
+	// Note there is no Args field, as this command takes no arguments of its
+	// own; an Args field would hold any remaining arguments from the command
+	// line. Without one, or any positional argument fields as in cat.go, an
+	// unknown word is reported as a mistyped subcommand, e.g.
+	// "sealeye-example vesion" suggests "version".
 	Subcommands map[string]interface{}
 }
 
 var root = &rootCLI{
 	Help: `
-Usage: {{.Command}} [options] subcommand [subcommand] ...
+Usage: {{.Usage}}
 
 This example program offers two simple subcommands, "cat" and "version". It is just to show the feature set of sealeye, a cli library for Go.
 
@@ -106,12 +189,20 @@ Also note that with the options, their usage text does **not** support Markdown
 	Func: func(cli *rootCLI) int {
 		if cli.Version {
 			fmt.Println("Version 1.2.3")
-			return 0
+			return sealeye.ExitOK
 		}
 		if cli.Debug {
 			fmt.Println("No subcommands were given; outputing help text.")
 		}
-		return 1
+		return sealeye.ExitFailure
+	},
+	PersistentBefore: func(cli *rootCLI) int {
+		if cli.Debug {
+			fmt.Println("Debug output enabled.")
+		}
+		return sealeye.ExitOK
 	},
-	Subcommands: map[string]interface{}{},
+	ConfigName:         "sealeye-example",
+	AllowAbbreviations: true,
+	Subcommands:        map[string]interface{}{},
 }
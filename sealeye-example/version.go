@@ -16,7 +16,6 @@ type versionCLI struct {
 	Help          string
 	QuickHelp     string
 	Func          func(cli *versionCLI) int
-	Args          []string
 	HelpOption    bool `option:"?,h,help" help:"Outputs this help text."`
 	AllHelpOption bool `option:"all-help" help:"Outputs this help text and the help text for all subcommands."`
 	// Silly example, but shows that subcommands can have subcommands; see
@@ -30,15 +29,10 @@ type versionCLI struct {
 
 var version = &versionCLI{
 	Help: `
-Usage: {{.Command}}
-
 Outputs the program's version.
 `,
 	QuickHelp: "Output the version of the program.",
 	Func: func(cli *versionCLI) int {
-		if len(cli.Args) > 0 {
-			return 1
-		}
 		fmt.Println("Version 1.2.3")
 		return 0
 	},
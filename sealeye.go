@@ -4,39 +4,92 @@
 // summary:
 //
 //  * Short options "-s" and long options "--long", with fallback to "-long" to support Go-like flags.
+//  * Values given as "--long value" or "--long=value"; booleans may be given explicitly as "--long=false".
+//  * Aggregated short options, "-abc" meaning "-a -b -c", with the last possibly taking a value, e.g. "-c3".
 //  * Multiple option names per option.
+//  * Optionally, long options and subcommands may be abbreviated to any unique prefix, e.g. "--pre" for "--prefix".
 //  * Boolean options can be flipped with "no" prefixing the long name, e.g. "--no-color".
 //  * Environment variable defaults support.
 //  * Multiple defaults support, for example "env:COUNT,123" which would use
 //    the option's value if the user set it, or the COUNT environment variable
 //    if that was set, or finally the plain value of 123 if all else failed.
-//  * Subcommands using the exact same structures.
+//  * Config file defaults, from a JSON or INI file named by a ConfigOption field, with sections for subcommands.
+//  * Named profiles in config files, chosen with a ProfileOption field, which may inherit from one another.
+//  * Config file discovery with a ConfigName field, merging .name.json from the current or a parent directory, the user's, and the system's.
+//  * Numeric options of any size, signed or unsigned integers or floats; integers may use Go style 0x, 0o, and 0b prefixes and _ separators.
+//  * Custom option types that implement encoding.TextUnmarshaler, such as time.Time, or sealeye.Value.
+//  * Restricting an option to a set of values with a tag like choices:"json,yaml,table".
+//  * Constraining option values with tags like min:"1", max:"65535", pattern:"^[a-z]+$", minlen:"1", and maxlen:"64".
+//  * Requiring an option be set, from the command line or a default, with required:"set".
+//  * Options that conflict with or require others, with tags like conflicts:"table" and requires:"key".
+//  * Repeatable options by using slices, such as []string, with each use appending another value.
+//  * Typed positional arguments, with tags like arg:"0" name:"SOURCE" or arg:"rest" for the remainder.
+//  * Usage lines generated from the options, arguments, and subcommands, added to the help text if it doesn't have one.
+//  * Subcommands using the exact same structures, with optional aliases given by an Aliases field.
+//  * Before and After hooks around Func, with PersistentBefore and PersistentAfter for all subcommands as well.
+//  * Func and hooks may take a context.Context, canceled by Run on SIGINT or SIGTERM.
+//  * Func and hooks may return an error instead of an exit code, with sealeye.Exit and sealeye.UsageError to control the result.
+//  * Suggestions for mistyped options and subcommands, such as: unknown option "--prefx"; did you mean "--prefix"?
+//  * Persistent options, with a tag like persistent:"true", accepted by all subcommands as well.
+//  * Where each option's value came from, with sealeye.Source or an ExplainOption field to output them all.
+//  * Outputting the effective option values as a config file with a DumpConfigOption field, leaving out any tagged secret:"true".
 //  * Options grouping, for DRY reuse, by simple struct embedding.
 //  * Markdown support for help text, reformatting to fit the terminal and using color if possible.
+//  * All output goes to the writers given to RunAdvanced, which may also specify the width to use.
 //  * Support for an --all-help option to output all help for all subcommands.
-//
-// Things To Be Done Still:
-//
-//  * Support for other types: floats, times, durations, maybe lists.
-//  * Handle --option=value format.
-//  * Handle -abc to be the equivalent of -a -b -c but only for short options.
 package sealeye
 
 import (
+	"bytes"
+	"context"
+	"encoding"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"go/ast"
 	"io"
+	"io/ioutil"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"reflect"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"text/template"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gholt/blackfridaytext"
 	"github.com/gholt/brimtext"
 	"github.com/mattn/go-isatty"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Exit codes returned by sealeye; a Func should generally follow these
+// conventions as well.
+const (
+	// ExitOK indicates success, and is also returned when help text was
+	// explicitly requested, such as with --help.
+	ExitOK = 0
+	// ExitFailure indicates a general failure, such as an invalid environment
+	// variable default. For backward compatibility, a Func returning
+	// ExitFailure will also have the full help text output; returning
+	// ErrShowHelp is the clearer way to ask for that.
+	ExitFailure = 1
+	// ExitUsage indicates the command line was in error, such as an unknown
+	// option or an invalid value. The error is output to stderr along with
+	// the usage line. A command can use a different code by having an
+	// UsageExitCode int field set to something other than 0; this applies to
+	// its subcommands as well if they have a Parent field.
+	ExitUsage = 2
+	// ExitInterrupted indicates the command was interrupted by a signal, such
+	// as from Ctrl-C, following the shell convention of 128 plus SIGINT's 2.
+	ExitInterrupted = 130
 )
 
 // Run is the top-level sealeye handler. Usually, assuming your top-level
@@ -45,27 +98,120 @@ import (
 //  func main() {
 //  	sealeye.Run(root)
 //  }
+//
+// Run also handles SIGINT and SIGTERM. While a Func or hook that takes a
+// context is running, such as func(ctx context.Context, cli *rootCLI) error,
+// the first signal cancels that context and Run then exits with
+// ExitInterrupted unless the command still succeeded; a second signal exits
+// immediately. At any other time, such as during a Func that takes no
+// context, the first signal exits immediately with ExitInterrupted.
 func Run(cli interface{}) {
-	os.Exit(runSubcommand(os.Stdout, os.Stderr, nil, os.Args[0], cli, os.Args[1:]))
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupts := &interruptState{}
+	ctx = context.WithValue(ctx, interruptKey{}, interrupts)
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		if atomic.LoadInt32(&interrupts.listening) == 0 {
+			os.Exit(ExitInterrupted)
+		}
+		cancel()
+		<-signals
+		os.Exit(ExitInterrupted)
+	}()
+	exitCode := runTopLevel(ctx, os.Stdout, os.Stderr, os.Args[0], cli, os.Args[1:])
+	if ctx.Err() != nil && exitCode != ExitOK {
+		exitCode = ExitInterrupted
+	}
+	os.Exit(exitCode)
+}
+
+// interruptState tracks, for Run, whether a Func or hook that takes a context
+// is running and so will notice the context being canceled by a signal.
+type interruptState struct {
+	listening int32
 }
 
+type interruptKey struct{}
+
 // RunAdvanced is much like Run except that you can specify stdout, stderr, and
 // the executable name and arguments yourself. Useful for tests, or an
 // interactive shell that calls various embedded CLIs, etc. Additionally,
 // RunAdvanced will not call os.Exit but will instead return the exit code to
 // you.
 func RunAdvanced(stdout FDWriter, stderr io.Writer, name string, cli interface{}, args []string) int {
-	return runSubcommand(stdout, stderr, nil, name, cli, args)
+	return RunAdvancedContext(context.Background(), stdout, stderr, name, cli, args)
+}
+
+// RunAdvancedContext is RunAdvanced with the context to give to any Func or
+// hook that takes one, such as func(ctx context.Context, cli *rootCLI) int.
+// Unlike Run, no signal handling is done; cancel the context yourself as
+// needed.
+func RunAdvancedContext(ctx context.Context, stdout FDWriter, stderr io.Writer, name string, cli interface{}, args []string) int {
+	return runTopLevel(ctx, stdout, stderr, name, cli, args)
+}
+
+// runTopLevel runs the top-level command, forgetting the sources recorded
+// for Source once done.
+func runTopLevel(ctx context.Context, stdout FDWriter, stderr io.Writer, name string, cli interface{}, args []string) int {
+	records := &[]*sourcesRecord{}
+	defer func() {
+		forgetSources(*records)
+	}()
+	return runSubcommand(ctx, stdout, stderr, &runState{records: records}, name, cli, args)
+}
+
+// runState is what a command passes along to its subcommand.
+type runState struct {
+	// ancestors are the commands leading to the subcommand, the top-level
+	// command first.
+	ancestors []interface{}
+	// persistent are the persistent options from the ancestors, by option
+	// name.
+	persistent map[string]*persistentOption
+	// path is the subcommand names leading to the subcommand, used to find
+	// its section of any config file.
+	path []string
+	// offset is the number of command line arguments before the
+	// subcommand's own, so that sources can give their overall positions.
+	offset int
+	// config is the ancestors' options as they would be in a config file,
+	// for dumping the effective config.
+	config []configEntry
+	// deferred are the ancestors' steps that must wait until the
+	// subcommand's command line has been parsed, since persistent options
+	// given there may affect them, the top-level command's first.
+	deferred []*deferredSteps
+	// records are the sources recorded for Source during the run, to be
+	// forgotten once it is done.
+	records *[]*sourcesRecord
 }
 
-func runSubcommand(stdout FDWriter, stderr io.Writer, parent interface{}, name string, cli interface{}, args []string) int {
+// deferredSteps are a command's defaulting and checking of its options that
+// are done by the subcommand that is actually run. For example, a persistent
+// config file option given after the subcommand name must still provide the
+// command's own defaults.
+type deferredSteps struct {
+	// applyDefaults applies the defaults for the options not given on the
+	// command line, returning a non-zero exit code on error.
+	applyDefaults func() int
+	// missing returns the names of any options and positional arguments
+	// required to be set that weren't.
+	missing func() (options, arguments []string)
+	// relationCheck ensures the options don't conflict with each other and
+	// that any options they require are also set.
+	relationCheck func() error
+}
+
+func runSubcommand(ctx context.Context, stdout FDWriter, stderr io.Writer, state *runState, name string, cli interface{}, args []string) int {
 	// Reflect down the value itself.
 	reflectValue := reflect.ValueOf(cli)
 	if reflectValue.Kind() == reflect.Ptr {
 		reflectValue = reflectValue.Elem()
 	}
-	if parentField := reflectValue.FieldByName("Parent"); parentField.Kind() != reflect.Invalid {
-		if parentValue := reflect.ValueOf(parent); parentValue.Kind() != reflect.Invalid {
+	if parentField := reflectValue.FieldByName("Parent"); parentField.Kind() != reflect.Invalid && len(state.ancestors) > 0 {
+		if parentValue := reflect.ValueOf(state.ancestors[len(state.ancestors)-1]); parentValue.Kind() != reflect.Invalid {
 			parentField.Set(parentValue)
 		}
 	}
@@ -85,27 +231,75 @@ func runSubcommand(stdout FDWriter, stderr io.Writer, parent interface{}, name s
 			hiddenSubcommands = nil
 		}
 	}
-
-	// Parse out the overall help text -- the top part without the options.
-	var helpText string
-	helpTemplate, err := template.New("help").Parse(reflectValue.FieldByName("Help").String())
-	if err != nil {
-		fmt.Fprintf(stderr, "Could not parse help text %q", reflectValue.FieldByName("Help").String())
-		panic(err)
+	// subcommandAliases maps each alias, from the subcommands' Aliases
+	// fields, to the name of the subcommand it stands for.
+	subcommandAliases := map[string]string{}
+	for _, subcommandsMap := range []map[string]interface{}{subcommands, hiddenSubcommands} {
+		for subcommandName, subcommand := range subcommandsMap {
+			for _, alias := range aliasesOf(subcommand) {
+				_, isSubcommand := subcommands[alias]
+				_, isHiddenSubcommand := hiddenSubcommands[alias]
+				if otherName, ok := subcommandAliases[alias]; isSubcommand || isHiddenSubcommand || (ok && otherName != subcommandName) {
+					panic(fmt.Sprintf("alias %q for subcommand %q is already in use", alias, subcommandName))
+				}
+				subcommandAliases[alias] = subcommandName
+			}
+		}
 	}
-	var helpBuilder strings.Builder
-	if err := helpTemplate.Execute(&helpBuilder, map[string]interface{}{"Command": name}); err != nil {
-		fmt.Fprintf(stderr, "Could not parse help text %q", reflectValue.FieldByName("Help").String())
-		panic(err)
+	// lookupSubcommand returns the subcommand for the name or alias, along
+	// with its actual name.
+	lookupSubcommand := func(nameOrAlias string) (string, interface{}, bool) {
+		if subcommandName, ok := subcommandAliases[nameOrAlias]; ok {
+			nameOrAlias = subcommandName
+		}
+		if subcommand, ok := subcommands[nameOrAlias]; ok {
+			return nameOrAlias, subcommand, true
+		}
+		subcommand, ok := hiddenSubcommands[nameOrAlias]
+		return nameOrAlias, subcommand, ok
+	}
+	// visibleSubcommandNames returns the names and aliases of all the
+	// subcommands that aren't hidden.
+	visibleSubcommandNames := func() []string {
+		var names []string
+		for subcommandName := range subcommands {
+			names = append(names, subcommandName)
+		}
+		for alias, subcommandName := range subcommandAliases {
+			if _, ok := subcommands[subcommandName]; ok {
+				names = append(names, alias)
+			}
+		}
+		return names
 	}
-	helpText = helpBuilder.String()
 
 	// Parse out the options and their types and requirements. We just record
-	// the option types as strings like, "bool", "int", etc. for simplicity as
-	// this really isn't going to be a performance choke point.
+	// the option types as strings like, "bool", "int", "[]string", etc. for
+	// simplicity as this really isn't going to be a performance choke point.
 	optionTypes := map[string]string{}
 	optionValues := map[string]reflect.Value{}
 	optionReqs := map[string]map[string]bool{}
+	// optionFields maps each option name to its struct field name, and
+	// optionTags to its struct field tag; since options can have multiple
+	// names, optionNames lists just the first name of each option, in order.
+	optionFields := map[string]string{}
+	optionTags := map[string]reflect.StructTag{}
+	var optionNames []string
+	// Positional arguments are recorded in the same option maps, keyed by
+	// their names such as "SOURCE"; argNames lists them in order and argRest
+	// is the name of any slice field taking all the remaining arguments.
+	var argNames []string
+	argIndexes := map[int]string{}
+	var argRest string
+	// optionsGiven records, by struct field name, which options were given on
+	// the command line and therefore should not be defaulted; optionsSet
+	// records which options were set by any means, including defaults.
+	optionsGiven := map[string]bool{}
+	optionsSet := map[string]bool{}
+	// sources records, by struct field name, where each option's value came
+	// from, as reported by Source.
+	sources := map[string]string{}
+	record := recordSources(state.records, cli, sources)
 	reqCheck := func(optionName, value string) error {
 		if optionReqs[optionName]["dir"] {
 			if fi, err := os.Stat(value); err != nil || !fi.IsDir() {
@@ -124,24 +318,431 @@ func runSubcommand(stdout FDWriter, stderr io.Writer, parent interface{}, name s
 		}
 		return nil
 	}
+	// parseOption parses a single value according to the option's type. The
+	// via text is appended to error messages to indicate where the value came
+	// from, such as " via $COUNT", and may be empty.
+	parseOption := func(optionName, value, via string) (reflect.Value, error) {
+		elemType := optionElemType(optionValues[optionName].Type(), optionTypes[optionName])
+		var parsed reflect.Value
+		switch strings.TrimPrefix(optionTypes[optionName], "[]") {
+		case "duration":
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return parsed, fmt.Errorf("invalid duration %q for %s%s", value, describeOption(optionName), via)
+			}
+			parsed = reflect.ValueOf(d)
+		case "bool":
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return parsed, fmt.Errorf("invalid boolean %q for %s%s", value, describeOption(optionName), via)
+			}
+			parsed = reflect.ValueOf(b)
+		case "int", "int8", "int16", "int32", "int64":
+			digits, base := integerBase(value)
+			i, err := strconv.ParseInt(digits, base, elemType.Bits())
+			if err != nil {
+				if numErr, ok := err.(*strconv.NumError); ok && numErr.Err == strconv.ErrRange {
+					return parsed, fmt.Errorf("integer %q out of range for %s%s; must fit in %s", value, describeOption(optionName), via, elemType.Kind())
+				}
+				return parsed, fmt.Errorf("invalid integer %q for %s%s", value, describeOption(optionName), via)
+			}
+			parsed = reflect.ValueOf(i)
+		case "uint", "uint8", "uint16", "uint32", "uint64":
+			digits, base := integerBase(value)
+			u, err := strconv.ParseUint(digits, base, elemType.Bits())
+			if err != nil {
+				if numErr, ok := err.(*strconv.NumError); ok && numErr.Err == strconv.ErrRange {
+					return parsed, fmt.Errorf("unsigned integer %q out of range for %s%s; must fit in %s", value, describeOption(optionName), via, elemType.Kind())
+				}
+				return parsed, fmt.Errorf("invalid unsigned integer %q for %s%s", value, describeOption(optionName), via)
+			}
+			parsed = reflect.ValueOf(u)
+		case "float32", "float64":
+			f, err := strconv.ParseFloat(value, elemType.Bits())
+			if err != nil {
+				if numErr, ok := err.(*strconv.NumError); ok && numErr.Err == strconv.ErrRange {
+					return parsed, fmt.Errorf("number %q out of range for %s%s; must fit in %s", value, describeOption(optionName), via, elemType.Kind())
+				}
+				return parsed, fmt.Errorf("invalid number %q for %s%s", value, describeOption(optionName), via)
+			}
+			parsed = reflect.ValueOf(f)
+		case "string":
+			parsed = reflect.ValueOf(value)
+		case "value":
+			parsed = reflect.New(elemType)
+			v := parsed.Interface().(Value)
+			if err := v.Set(value); err != nil {
+				return parsed, fmt.Errorf("invalid %s %q for %s%s: %s", v.Type(), value, describeOption(optionName), via, err)
+			}
+			parsed = parsed.Elem()
+		case "text":
+			parsed = reflect.New(elemType)
+			if err := parsed.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(value)); err != nil {
+				return parsed, fmt.Errorf("invalid value %q for %s%s: %s", value, describeOption(optionName), via, err)
+			}
+			parsed = parsed.Elem()
+		default:
+			panic(fmt.Sprintln("sealeye programmer error [2]", optionTypes[optionName]))
+		}
+		return parsed, nil
+	}
+	// optionChoices holds the parsed values of any choices tag, by option
+	// name; the option's value must then be one of those choices.
+	optionChoices := map[string][]reflect.Value{}
+	// optionMins and optionMaxes hold the parsed values of any min and max
+	// tags, and optionPatterns the compiled pattern tags, by option name.
+	optionMins := map[string]reflect.Value{}
+	optionMaxes := map[string]reflect.Value{}
+	optionPatterns := map[string]*regexp.Regexp{}
+	constraintCheck := func(optionName, value string, parsed reflect.Value, via string) error {
+		tag := optionTags[optionName]
+		if min, ok := optionMins[optionName]; ok && compareValues(parsed, min) < 0 {
+			return fmt.Errorf("invalid value %q for %s%s; must be at least %s", value, describeOption(optionName), via, tag.Get("min"))
+		}
+		if max, ok := optionMaxes[optionName]; ok && compareValues(parsed, max) > 0 {
+			return fmt.Errorf("invalid value %q for %s%s; must be at most %s", value, describeOption(optionName), via, tag.Get("max"))
+		}
+		if pattern := optionPatterns[optionName]; pattern != nil && !pattern.MatchString(value) {
+			return fmt.Errorf("invalid value %q for %s%s; must match %s", value, describeOption(optionName), via, tag.Get("pattern"))
+		}
+		if minlen := tag.Get("minlen"); minlen != "" {
+			if n, _ := strconv.Atoi(minlen); utf8.RuneCountInString(value) < n {
+				return fmt.Errorf("invalid value %q for %s%s; must be at least %s characters", value, describeOption(optionName), via, minlen)
+			}
+		}
+		if maxlen := tag.Get("maxlen"); maxlen != "" {
+			if n, _ := strconv.Atoi(maxlen); utf8.RuneCountInString(value) > n {
+				return fmt.Errorf("invalid value %q for %s%s; must be at most %s characters", value, describeOption(optionName), via, maxlen)
+			}
+		}
+		return nil
+	}
+	// setOption parses the value according to the option's type, checks any
+	// choices and requirements, and then sets the option's value. Slice
+	// options have the value appended instead, split by their sep tag if they
+	// have one.
+	setOption := func(optionName, value, via string) error {
+		values := []string{value}
+		if sep := optionTags[optionName].Get("sep"); sep != "" {
+			values = strings.Split(value, sep)
+		}
+		for _, value := range values {
+			parsed, err := parseOption(optionName, value, via)
+			if err != nil {
+				return err
+			}
+			if choices := optionChoices[optionName]; choices != nil {
+				valid := false
+				for _, choice := range choices {
+					if reflect.DeepEqual(parsed.Interface(), choice.Interface()) {
+						valid = true
+						break
+					}
+				}
+				if !valid {
+					return fmt.Errorf("invalid choice %q for %s%s; must be one of: %s", value, describeOption(optionName), via, strings.Join(strings.Split(optionTags[optionName].Get("choices"), ","), ", "))
+				}
+			}
+			if err := constraintCheck(optionName, value, parsed, via); err != nil {
+				return err
+			}
+			if strings.TrimPrefix(optionTypes[optionName], "[]") == "string" {
+				if err := reqCheck(optionName, value); err != nil {
+					return requirementError{fmt.Errorf("%s%s", err, via)}
+				}
+			}
+			setValue(optionValues[optionName], parsed)
+		}
+		optionsSet[optionFields[optionName]] = true
+		return nil
+	}
+	// setDefault is like setOption but for default values, which replace
+	// rather than append to slice options. Multiple default values for slice
+	// options are separated by their sep tag, or by commas if they have none.
+	setDefault := func(optionName, value, via string) error {
+		if !strings.HasPrefix(optionTypes[optionName], "[]") {
+			return setOption(optionName, value, via)
+		}
+		optionValues[optionName].Set(reflect.Zero(optionValues[optionName].Type()))
+		if value == "" {
+			return nil
+		}
+		sep := optionTags[optionName].Get("sep")
+		if sep == "" {
+			sep = ","
+		}
+		for _, value := range strings.Split(value, sep) {
+			if err := setOption(optionName, value, via); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// setConfig sets the option from its value or values in a config file.
+	// Relative paths for options required to be a file or directory are
+	// relative to the config file's directory.
+	setConfig := func(optionName string, value *configValue) error {
+		via := " via " + value.where
+		values := value.values
+		if optionReqs[optionName]["file"] || optionReqs[optionName]["dir"] || optionReqs[optionName]["dirorfile"] {
+			values = make([]string, len(value.values))
+			for k, v := range value.values {
+				if v != "" && !filepath.IsAbs(v) {
+					v = filepath.Join(value.dir, v)
+				}
+				values[k] = v
+			}
+		}
+		if len(values) == 1 {
+			return setDefault(optionName, values[0], via)
+		}
+		if !strings.HasPrefix(optionTypes[optionName], "[]") {
+			return fmt.Errorf("multiple values for %s%s", describeOption(optionName), via)
+		}
+		optionValues[optionName].Set(reflect.Zero(optionValues[optionName].Type()))
+		for _, v := range values {
+			if err := setOption(optionName, v, via); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// applyDefault sets the option, if it wasn't given on the command line,
+	// from the first of its defaults that provides a value. Any config file is
+	// checked first, unless the default tag places a "config:" entry
+	// elsewhere. The config file option itself and positional arguments are
+	// never set from a config file.
+	tty := 0
+	applyDefault := func(optionName string, config *configFile) int {
+		if optionsGiven[optionFields[optionName]] {
+			return 0
+		}
+		defaultTag := optionTags[optionName].Get("default")
+		dflts := splitDefaults(defaultTag)
+		if config != nil && optionName[0] == '-' && !strings.Contains(","+defaultTag, ",config:") {
+			dflts = append([]string{"config:"}, dflts...)
+		}
+	DEFAULTING:
+		for _, dflt := range dflts {
+			if dflt == "" {
+				continue
+			} else if strings.HasPrefix(dflt, "config:") {
+				if config == nil {
+					continue
+				}
+				keys := []string{dflt[len("config:"):]}
+				if keys[0] == "" {
+					keys = strings.Split(optionTags[optionName].Get("option"), ",")
+				}
+				if value := config.lookup(state.path, keys); value != nil {
+					if err := setConfig(optionName, value); err != nil {
+						fmt.Fprintln(stderr, err)
+						return 1
+					}
+					sources[optionFields[optionName]] = value.where
+					break DEFAULTING
+				}
+			} else if strings.HasPrefix(dflt, "env:") {
+				envdflt := dflt[len("env:"):]
+				prefix := ""
+				suffix := ""
+				i := strings.IndexByte(envdflt, '{')
+				if i >= 0 {
+					j := strings.IndexByte(envdflt[i:], '}')
+					if j >= 0 {
+						j += i
+						prefix = envdflt[:i]
+						suffix = envdflt[j+1:]
+						envdflt = envdflt[i+1 : j]
+					}
+				}
+				if env, ok := os.LookupEnv(envdflt); ok {
+					if err := setDefault(optionName, prefix+env+suffix, " via $"+envdflt); err != nil {
+						fmt.Fprintln(stderr, err)
+						return 1
+					}
+					sources[optionFields[optionName]] = "$" + envdflt
+					break DEFAULTING
+				}
+			} else if dflt == "terminal" {
+				if tty == 0 {
+					if isatty.IsTerminal(stdout.Fd()) {
+						tty = 1
+					} else {
+						tty = -1
+					}
+				}
+				setValue(optionValues[optionName], reflect.ValueOf(tty == 1))
+				optionsSet[optionFields[optionName]] = true
+				sources[optionFields[optionName]] = "terminal"
+				break DEFAULTING
+			} else {
+				if err := setDefault(optionName, dflt, ""); err != nil {
+					// A failed requirement, such as a default file not
+					// existing, is a runtime error; anything else is a bad
+					// default specification.
+					if _, ok := err.(requirementError); ok {
+						fmt.Fprintln(stderr, err)
+						return 1
+					}
+					panic(fmt.Sprintf("cannot handle default specification %q from %q: %s", dflt, defaultTag, err))
+				}
+				sources[optionFields[optionName]] = "default"
+				break DEFAULTING
+			}
+		}
+		return 0
+	}
+	// nearestField returns our string field by the name or, if we don't have
+	// one, the nearest ancestor's.
+	nearestField := func(fieldName string) string {
+		for i := len(state.ancestors); i >= 0; i-- {
+			commandValue := reflectValue
+			if i < len(state.ancestors) {
+				commandValue = reflect.ValueOf(state.ancestors[i])
+				if commandValue.Kind() == reflect.Ptr {
+					commandValue = commandValue.Elem()
+				}
+			}
+			if field := commandValue.FieldByName(fieldName); field.Kind() == reflect.String {
+				return field.String()
+			}
+		}
+		return ""
+	}
+	// applyDefaults applies the defaults for all options and positional
+	// arguments. The config file and profile options, if we have them, are
+	// defaulted first so the file and profile they name can be used for the
+	// rest; otherwise, the nearest ancestor's are used. Values in that file
+	// take precedence over any found by the ConfigName discovery.
+	applyDefaults := func() int {
+		for _, optionName := range optionNames {
+			if optionFields[optionName] == "ConfigOption" || optionFields[optionName] == "ProfileOption" {
+				if code := applyDefault(optionName, nil); code != 0 {
+					return code
+				}
+			}
+		}
+		var configPaths []string
+		if configPath := nearestField("ConfigOption"); configPath != "" {
+			configPaths = append(configPaths, configPath)
+		}
+		if configName := nearestField("ConfigName"); configName != "" {
+			configPaths = append(configPaths, discoverConfigFiles(configName)...)
+		}
+		var config *configFile
+		for _, configPath := range configPaths {
+			loaded, err := loadConfigFile(configPath)
+			if err != nil {
+				fmt.Fprintln(stderr, err)
+				return 1
+			}
+			if config == nil {
+				config = loaded
+			} else {
+				config.merge(loaded)
+			}
+		}
+		if profile := nearestField("ProfileOption"); profile != "" {
+			if config == nil {
+				config = &configFile{sections: map[string]map[string]*configValue{}}
+			}
+			if err := config.useProfile(profile); err != nil {
+				fmt.Fprintln(stderr, err)
+				return 1
+			}
+		}
+		for _, optionName := range append(append(append([]string{}, optionNames...), argNames...), argRest) {
+			if optionName == "" || optionFields[optionName] == "ConfigOption" || optionFields[optionName] == "ProfileOption" {
+				continue
+			}
+			if code := applyDefault(optionName, config); code != 0 {
+				return code
+			}
+		}
+		return 0
+	}
 	// Also, parse out the option help data, which is a table of each option
 	// and its help text.
 	var optionHelpData [][]string
+	var argHelpData [][]string
 	var multilineOptionHelpData [][]string
 	maxOptionLen := 0
-	tty := 0
+	// ownPersistent records our own options marked persistent:"true", to be
+	// passed down to our subcommands along with those we inherited.
+	ownPersistent := map[string]*persistentOption{}
 	topFields := map[string]bool{}
 	for i := 0; i < reflectValue.Type().NumField(); i++ {
 		topFields[reflectValue.Type().Field(i).Name] = true
 	}
-	var reflectFunc func(reflectType reflect.Type, embeddedStruct bool) int
-	reflectFunc = func(reflectType reflect.Type, embeddedStruct bool) int {
+	// registerOption records the option's details in all the option maps,
+	// parsing and checking the various tags that constrain its values.
+	registerOption := func(optionName, optionType string, reflectField reflect.StructField) {
+		optionTypes[optionName] = optionType
+		optionValues[optionName] = reflectValue.FieldByName(reflectField.Name)
+		optionFields[optionName] = reflectField.Name
+		optionTags[optionName] = reflectField.Tag
+		optionReqs[optionName] = map[string]bool{}
+		for _, req := range strings.Split(reflectField.Tag.Get("required"), ",") {
+			switch req {
+			case "":
+			case "dir", "dirorfile", "file", "set":
+				optionReqs[optionName][req] = true
+			default:
+				panic(fmt.Sprintf("unknown required value: %q", req))
+			}
+		}
+		for _, limit := range []struct {
+			tag    string
+			values map[string]reflect.Value
+		}{{"min", optionMins}, {"max", optionMaxes}} {
+			if limitValue := reflectField.Tag.Get(limit.tag); limitValue != "" {
+				switch strings.TrimPrefix(optionType, "[]") {
+				case "duration", "int", "int8", "int16", "int32", "int64", "uint", "uint8", "uint16", "uint32", "uint64", "float32", "float64":
+				default:
+					panic(fmt.Sprintf("%s tag given for non-numeric option %s", limit.tag, reflectField.Name))
+				}
+				parsed, err := parseOption(optionName, limitValue, "")
+				if err != nil {
+					panic(fmt.Sprintf("cannot handle %s specification %q: %s", limit.tag, limitValue, err))
+				}
+				limit.values[optionName] = parsed
+			}
+		}
+		for _, tag := range []string{"pattern", "minlen", "maxlen"} {
+			if reflectField.Tag.Get(tag) != "" && strings.TrimPrefix(optionType, "[]") != "string" {
+				panic(fmt.Sprintf("%s tag given for non-string option %s", tag, reflectField.Name))
+			}
+		}
+		for _, tag := range []string{"minlen", "maxlen"} {
+			if n := reflectField.Tag.Get(tag); n != "" {
+				if _, err := strconv.Atoi(n); err != nil {
+					panic(fmt.Sprintf("cannot handle %s specification %q: %s", tag, n, err))
+				}
+			}
+		}
+		if pattern := reflectField.Tag.Get("pattern"); pattern != "" {
+			optionPatterns[optionName] = regexp.MustCompile(pattern)
+		}
+		if choices := reflectField.Tag.Get("choices"); choices != "" {
+			if optionType == "bool" {
+				panic(fmt.Sprintf("choices tag given for bool option %s", reflectField.Name))
+			}
+			for _, choice := range strings.Split(choices, ",") {
+				parsed, err := parseOption(optionName, choice, "")
+				if err != nil {
+					panic(fmt.Sprintf("cannot handle choice %q from %q: %s", choice, choices, err))
+				}
+				optionChoices[optionName] = append(optionChoices[optionName], parsed)
+			}
+		}
+	}
+	var reflectFunc func(reflectType reflect.Type, embeddedStruct bool)
+	reflectFunc = func(reflectType reflect.Type, embeddedStruct bool) {
 		for i := 0; i < reflectType.NumField(); i++ {
 			reflectField := reflectType.Field(i)
 			if reflectField.Type.Kind() == reflect.Struct {
-				if code := reflectFunc(reflectField.Type, true); code != 0 {
-					return code
-				}
+				reflectFunc(reflectField.Type, true)
 			}
 			// Skip fields in embedded structs that are overridden by the top
 			// level struct.
@@ -152,31 +753,20 @@ func runSubcommand(stdout FDWriter, stderr io.Writer, parent interface{}, name s
 				continue
 			}
 			optionTag := reflectField.Tag.Get("option")
-			if optionTag == "" {
+			argTag := reflectField.Tag.Get("arg")
+			if optionTag == "" && argTag == "" {
 				continue
 			}
-			var optionType string
-			switch reflectField.Type {
-			case reflect.TypeOf(time.Duration(0)):
-				optionType = "duration"
-			default:
-				eventualKind := reflectField.Type.Kind()
-				if eventualKind == reflect.Ptr {
-					eventualKind = reflectField.Type.Elem().Kind()
-				}
-				switch eventualKind {
-				case reflect.Bool:
-					optionType = "bool"
-				case reflect.Int:
-					optionType = "int"
-				case reflect.String:
-					optionType = "string"
-				default:
-					panic(fmt.Sprintln("cannot handle", reflectField.Type, reflectField.Name, reflectField.Type.Kind()))
-				}
+			if optionTag != "" && argTag != "" {
+				panic(fmt.Sprintf("both option and arg tags given for %s", reflectField.Name))
+			}
+			optionType := fieldOptionType(reflectField)
+			fieldType := optionElemType(reflectField.Type, optionType)
+			if reflectField.Tag.Get("sep") != "" && !strings.HasPrefix(optionType, "[]") {
+				panic(fmt.Sprintf("sep tag given for non-slice option %s", reflectField.Name))
 			}
 			var defaultsHelp []string
-			for _, dflt := range strings.Split(reflectField.Tag.Get("default"), ",") {
+			for _, dflt := range splitDefaults(reflectField.Tag.Get("default")) {
 				if dflt == "" {
 					continue
 				} else if strings.HasPrefix(dflt, "env:") {
@@ -189,6 +779,12 @@ func runSubcommand(stdout FDWriter, stderr io.Writer, parent interface{}, name s
 							defaultsHelp[len(defaultsHelp)-1] = envdflt[:i] + "$" + envdflt[i:]
 						}
 					}
+				} else if strings.HasPrefix(dflt, "config:") {
+					if key := dflt[len("config:"):]; key != "" {
+						defaultsHelp = append(defaultsHelp, "config "+key)
+					} else {
+						defaultsHelp = append(defaultsHelp, "config")
+					}
 				} else if dflt == "terminal" {
 					defaultsHelp = append(defaultsHelp, "if terminal")
 				} else {
@@ -205,10 +801,89 @@ func runSubcommand(stdout FDWriter, stderr io.Writer, parent interface{}, name s
 					reqsHelp = append(reqsHelp, "must be a directory or file")
 				case "file":
 					reqsHelp = append(reqsHelp, "must be a file")
+				case "set":
 				default:
 					panic(fmt.Sprintf("unknown required value: %q", req))
 				}
 			}
+			if min := reflectField.Tag.Get("min"); min != "" {
+				reqsHelp = append(reqsHelp, "must be at least "+min)
+			}
+			if max := reflectField.Tag.Get("max"); max != "" {
+				reqsHelp = append(reqsHelp, "must be at most "+max)
+			}
+			if minlen := reflectField.Tag.Get("minlen"); minlen != "" {
+				reqsHelp = append(reqsHelp, "must be at least "+minlen+" characters")
+			}
+			if maxlen := reflectField.Tag.Get("maxlen"); maxlen != "" {
+				reqsHelp = append(reqsHelp, "must be at most "+maxlen+" characters")
+			}
+			if pattern := reflectField.Tag.Get("pattern"); pattern != "" {
+				reqsHelp = append(reqsHelp, "must match "+pattern)
+			}
+			optionHelpText := reflectField.Tag.Get("help")
+			if strings.Contains(","+reflectField.Tag.Get("required")+",", ",set,") {
+				optionHelpText += " (required)"
+			}
+			if choices := reflectField.Tag.Get("choices"); choices != "" {
+				optionHelpText += " Choices: " + strings.Join(strings.Split(choices, ","), ", ")
+			}
+			if len(reqsHelp) > 0 {
+				optionHelpText += " Requirements: " + strings.Join(reqsHelp, ", ")
+			}
+			if len(defaultsHelp) > 0 {
+				optionHelpText += " Default: " + strings.Join(defaultsHelp, ", ")
+			}
+			for _, relation := range []struct{ tag, text string }{{"conflicts", "Conflicts with"}, {"requires", "Requires"}} {
+				var relatedNames []string
+				for _, relatedName := range strings.Split(reflectField.Tag.Get(relation.tag), ",") {
+					if len(relatedName) == 1 {
+						relatedNames = append(relatedNames, "-"+relatedName)
+					} else if relatedName != "" {
+						relatedNames = append(relatedNames, "--"+relatedName)
+					}
+				}
+				if len(relatedNames) > 0 {
+					optionHelpText += " " + relation.text + ": " + strings.Join(relatedNames, ", ")
+				}
+			}
+			if argTag != "" {
+				if reflectField.Tag.Get("persistent") == "true" {
+					panic(fmt.Sprintf("persistent tag given for positional argument %s", reflectField.Name))
+				}
+				argName := reflectField.Tag.Get("name")
+				if argName == "" {
+					argName = strings.ToUpper(reflectField.Name)
+				}
+				if strings.HasPrefix(argName, "-") {
+					panic(fmt.Sprintf("argument name %q for %s cannot begin with a dash", argName, reflectField.Name))
+				}
+				argHelpName := argName
+				if argTag == "rest" {
+					if !strings.HasPrefix(optionType, "[]") {
+						panic(fmt.Sprintf("arg:\"rest\" given for non-slice field %s", reflectField.Name))
+					}
+					argRest = argName
+					argHelpName += "..."
+				} else {
+					argIndex, err := strconv.Atoi(argTag)
+					if err != nil || argIndex < 0 {
+						panic(fmt.Sprintf("cannot handle arg specification %q for %s", argTag, reflectField.Name))
+					}
+					if argIndexes[argIndex] != "" {
+						panic(fmt.Sprintf("arg %d given for both %s and %s", argIndex, optionFields[argIndexes[argIndex]], reflectField.Name))
+					}
+					argIndexes[argIndex] = argName
+				}
+				registerOption(argName, optionType, reflectField)
+				if len(argHelpName) > maxOptionLen {
+					maxOptionLen = len(argHelpName)
+				}
+				if reflectField.Tag.Get("hidden") != "true" {
+					argHelpData = append(argHelpData, []string{"", argHelpName, optionHelpText})
+				}
+				continue
+			}
 			var optionHelpNames []string
 			for _, optionName := range strings.Split(optionTag, ",") {
 				if optionName != "" {
@@ -218,264 +893,596 @@ func runSubcommand(stdout FDWriter, stderr io.Writer, parent interface{}, name s
 						optionName = "--" + optionName
 					}
 					optionHelpName := optionName
-					switch optionType {
+					switch strings.TrimPrefix(optionType, "[]") {
 					case "duration":
 						optionHelpName += " d"
 					case "bool":
-					case "int":
+					case "int", "int8", "int16", "int32", "int64":
 						optionHelpName += " n"
+					case "uint", "uint8", "uint16", "uint32", "uint64":
+						optionHelpName += " u"
+					case "float32", "float64":
+						optionHelpName += " f"
 					case "string":
 						optionHelpName += " s"
+					case "value":
+						optionHelpName += " " + reflect.New(fieldType).Interface().(Value).Type()
+					case "text":
+						if fieldType.Name() != "" {
+							optionHelpName += " " + strings.ToLower(fieldType.Name())
+						} else {
+							optionHelpName += " s"
+						}
 					default:
 						panic(fmt.Sprintln("sealeye programmer error [1]", optionType))
 					}
+					if strings.HasPrefix(optionType, "[]") {
+						optionHelpName += "..."
+					}
 					if len(optionHelpName) > maxOptionLen {
 						maxOptionLen = len(optionHelpName)
 					}
-					optionHelpNames = append(optionHelpNames, optionHelpName)
-					optionTypes[optionName] = optionType
-					optionValues[optionName] = reflectValue.FieldByName(reflectField.Name)
-					optionReqs[optionName] = map[string]bool{}
-					for _, req := range strings.Split(reflectField.Tag.Get("required"), ",") {
-						switch req {
-						case "":
-						case "dir", "dirorfile", "file":
-							optionReqs[optionName][req] = true
-						default:
-							panic(fmt.Sprintf("unknown required value: %q", req))
-						}
-					}
-				DEFAULTING:
-					for _, dflt := range strings.Split(reflectField.Tag.Get("default"), ",") {
-						if dflt == "" {
-							continue
-						} else if strings.HasPrefix(dflt, "env:") {
-							envdflt := dflt[len("env:"):]
-							prefix := ""
-							suffix := ""
-							i := strings.IndexByte(envdflt, '{')
-							if i >= 0 {
-								j := strings.IndexByte(envdflt[i:], '}')
-								if j >= 0 {
-									j += i
-									prefix = envdflt[:i]
-									suffix = envdflt[j+1:]
-									envdflt = envdflt[i+1 : j]
-								}
-							}
-							if env, ok := os.LookupEnv(envdflt); ok {
-								env = prefix + env + suffix
-								switch optionType {
-								case "duration":
-									d, err := time.ParseDuration(env)
-									if err != nil {
-										fmt.Fprintf(stderr, "invalid duration %q for option %q via $%s\n", env, optionName, envdflt)
-										return 1
-									}
-									setDuration(optionValues[optionName], d)
-								case "bool":
-									b, err := strconv.ParseBool(env)
-									if err != nil {
-										fmt.Fprintf(stderr, "invalid boolean %q for option %q via $%s\n", env, optionName, envdflt)
-										return 1
-									}
-									setBool(optionValues[optionName], b)
-								case "int":
-									i, err := strconv.ParseInt(env, 10, 64)
-									if err != nil {
-										fmt.Fprintf(stderr, "invalid integer %q for option %q via $%s\n", env, optionName, envdflt)
-										return 1
-									}
-									setInt(optionValues[optionName], i)
-								case "string":
-									if err := reqCheck(optionName, env); err != nil {
-										fmt.Fprintln(stderr, err)
-										return 1
-									}
-									setString(optionValues[optionName], env)
-								default:
-									panic(fmt.Sprintln("sealeye programmer error [2]", optionType))
-								}
-								break DEFAULTING
-							}
-						} else if dflt == "terminal" {
-							if tty == 0 {
-								if isatty.IsTerminal(stdout.Fd()) {
-									tty = 1
-								} else {
-									tty = -1
-								}
-							}
-							setBool(optionValues[optionName], tty == 1)
-							break DEFAULTING
-						} else {
-							switch optionType {
-							case "duration":
-								d, err := time.ParseDuration(dflt)
-								if err != nil {
-									panic(fmt.Sprintf("cannot handle default specification %q from %q: %s", dflt, reflectField.Tag.Get("default"), err))
-
-								}
-								setDuration(optionValues[optionName], d)
-							case "bool":
-								b, err := strconv.ParseBool(dflt)
-								if err != nil {
-									panic(fmt.Sprintf("cannot handle default specification %q from %q: %s", dflt, reflectField.Tag.Get("default"), err))
-
-								}
-								setBool(optionValues[optionName], b)
-							case "int":
-								i, err := strconv.ParseInt(dflt, 10, 64)
-								if err != nil {
-									panic(fmt.Sprintf("cannot handle default specification %q from %q: %s", dflt, reflectField.Tag.Get("default"), err))
-
-								}
-								setInt(optionValues[optionName], i)
-							case "string":
-								if err := reqCheck(optionName, dflt); err != nil {
-									fmt.Fprintln(stderr, err)
-									return 1
-								}
-								setString(optionValues[optionName], dflt)
-							default:
-								panic(fmt.Sprintln("sealeye programmer error [3]", optionType))
-							}
-							break DEFAULTING
-						}
+					if len(optionHelpNames) == 0 {
+						optionNames = append(optionNames, optionName)
 					}
+					optionHelpNames = append(optionHelpNames, optionHelpName)
+					registerOption(optionName, optionType, reflectField)
 				}
 			}
+			var helpRow []string
 			if reflectField.Tag.Get("hidden") != "true" {
-				optionHelpText := reflectField.Tag.Get("help")
-				if len(reqsHelp) > 0 {
-					optionHelpText += " Requirements: " + strings.Join(reqsHelp, ", ")
-				}
-				if len(defaultsHelp) > 0 {
-					optionHelpText += " Default: " + strings.Join(defaultsHelp, ", ")
-				}
 				if len(optionHelpNames) == 1 {
 					if optionHelpNames[0] != "--all-help" || subcommands != nil {
-						optionHelpData = append(optionHelpData, []string{"", optionHelpNames[0], optionHelpText})
+						helpRow = []string{"", optionHelpNames[0], optionHelpText}
+						optionHelpData = append(optionHelpData, helpRow)
 					}
 				} else {
 					if optionType == "bool" {
 						if s := strings.Join(optionHelpNames, " "); len(s) < 15 {
-							optionHelpData = append(optionHelpData, []string{"", s, optionHelpText})
+							helpRow = []string{"", s, optionHelpText}
+							optionHelpData = append(optionHelpData, helpRow)
 						} else {
-							multilineOptionHelpData = append(multilineOptionHelpData, []string{"", strings.Join(optionHelpNames, "\n"), optionHelpText})
+							helpRow = []string{"", strings.Join(optionHelpNames, "\n"), optionHelpText}
+							multilineOptionHelpData = append(multilineOptionHelpData, helpRow)
 						}
 					} else {
-						multilineOptionHelpData = append(multilineOptionHelpData, []string{"", strings.Join(optionHelpNames, "\n"), optionHelpText})
+						helpRow = []string{"", strings.Join(optionHelpNames, "\n"), optionHelpText}
+						multilineOptionHelpData = append(multilineOptionHelpData, helpRow)
+					}
+				}
+			}
+			if reflectField.Tag.Get("persistent") == "true" {
+				option := &persistentOption{
+					optionType: optionType,
+					fieldName:  reflectField.Name,
+					value:      reflectValue.FieldByName(reflectField.Name),
+					tag:        reflectField.Tag,
+					sources:    sources,
+					helpRow:    helpRow,
+				}
+				for _, optionHelpName := range optionHelpNames {
+					ownPersistent[strings.SplitN(optionHelpName, " ", 2)[0]] = option
+					if len(optionHelpName) > option.helpLen {
+						option.helpLen = len(optionHelpName)
 					}
 				}
 			}
 		}
-		return 0
 	}
-	if code := reflectFunc(reflectValue.Type(), false); code != 0 {
-		return code
+	reflectFunc(reflectValue.Type(), false)
+	// Accept the persistent options we inherited, unless we have our own
+	// options by the same names. If we have a field of the same name and
+	// type that isn't one of our own options, it is kept up to date with the
+	// inherited option's value.
+	inherited := map[string]*persistentOption{}
+	ownFields := map[string]bool{}
+	for _, fieldName := range optionFields {
+		ownFields[fieldName] = true
 	}
-
-	// Scan the command line for options and remaining args, possibly switching
-	// context to a subcommand.
-	var remainingArgs []string
-	// noMore will be set true if we encounter a "--" alone; conventionally
-	// means "no more options follow".
-	noMore := false
-	for i := 0; i < len(args); i++ {
-		arg := args[i]
-		addArg := func() (bool, int) {
-			if subcommand, ok := subcommands[arg]; ok {
-				return true, runSubcommand(stdout, stderr, cli, name+" "+arg, subcommand, args[i+1:])
-			}
-			if subcommand, ok := hiddenSubcommands[arg]; ok {
-				return true, runSubcommand(stdout, stderr, cli, name+" "+arg, subcommand, args[i+1:])
-			}
-			remainingArgs = append(remainingArgs, arg)
-			return false, 0
+	for optionName, option := range state.persistent {
+		if _, ok := optionTypes[optionName]; ok {
+			continue
 		}
-		if noMore {
-			if ret, code := addArg(); ret {
-				return code
-			}
+		inherited[optionName] = option
+		optionTypes[optionName] = option.optionType
+		optionTags[optionName] = option.tag
+		if option.helpRow != nil && option.helpLen > maxOptionLen {
+			maxOptionLen = option.helpLen
+		}
+		if copyField := reflectValue.FieldByName(option.fieldName); !ownFields[option.fieldName] && copyField.CanSet() && copyField.Type() == option.value.Type() {
+			copyField.Set(option.value)
+			option.copies = append(option.copies, copyField)
+			record.copies[option.fieldName] = option
+		}
+	}
+	// ownConfig is our options as they would be in a config file, keyed by
+	// their "config:" default or first long name. Positional arguments, the
+	// built-in options, and options marked hidden or secret are left out.
+	var ownConfig []configEntry
+	for _, optionName := range optionNames {
+		switch optionFields[optionName] {
+		case "HelpOption", "AllHelpOption", "ExplainOption", "DumpConfigOption", "ConfigOption", "ProfileOption":
 			continue
 		}
-		if len(arg) > 1 && arg[0] == '-' {
-			optionType, ok := optionTypes[arg]
-			if !ok {
-				// If we didn't find a match for the option, and it begins with
-				// just a single dash, try it with a double-dash for backward
-				// compatibility with Go's flag library which allows options
-				// like -version to mean the more standard --version option.
-				//
-				// GLH: Note that this will have tension with treating -abc as
-				// if it were -a -b -c as is standard with most CLIs. When code
-				// is added to try to "explode" such aggregate short options,
-				// it should take precedence over this code trying to treat it
-				// as an --abc long option.
-				if len(arg) > 1 && arg[1] != '-' {
-					arg = "-" + arg
-					optionType, ok = optionTypes[arg]
-				}
-				// If still didn't find a match for the option, and it happens
-				// to be --all-help, just pretend it was --help.
-				if !ok && arg == "--all-help" {
-					arg = "--help"
-					optionType = optionTypes[arg]
-				}
+		tag := optionTags[optionName]
+		if tag.Get("hidden") == "true" || tag.Get("secret") == "true" {
+			continue
+		}
+		var key string
+		for _, dflt := range splitDefaults(tag.Get("default")) {
+			if strings.HasPrefix(dflt, "config:") && dflt != "config:" {
+				key = dflt[len("config:"):]
 			}
-			switch optionType {
-			case "duration":
-				if len(args) == i+1 {
-					fmt.Fprintf(stderr, "no value given for option %q\n", arg)
-					return 1
-				}
-				i++
-				d, err := time.ParseDuration(args[i])
-				if err != nil {
-					fmt.Fprintf(stderr, "invalid duration %q for option %q\n", args[i], arg)
-					return 1
-				}
-				setDuration(optionValues[arg], d)
-			case "bool":
-				setBool(optionValues[arg], true)
-			case "int":
-				if len(args) == i+1 {
-					fmt.Fprintf(stderr, "no value given for option %q\n", arg)
-					return 1
-				}
-				i++
-				v, err := strconv.ParseInt(args[i], 10, 64)
-				if err != nil {
-					fmt.Fprintf(stderr, "invalid int %q for option %q\n", args[i], arg)
-					return 1
+		}
+		if key == "" {
+			key = strings.TrimLeft(longName(optionName, tag), "-")
+		}
+		ownConfig = append(ownConfig, configEntry{
+			path:       state.path,
+			key:        key,
+			optionType: optionTypes[optionName],
+			value:      optionValues[optionName],
+			absolute:   optionReqs[optionName]["file"] || optionReqs[optionName]["dir"] || optionReqs[optionName]["dirorfile"],
+		})
+	}
+	for argIndex := 0; argIndex < len(argIndexes); argIndex++ {
+		argName, ok := argIndexes[argIndex]
+		if !ok {
+			panic(fmt.Sprintf("arg %d missing; arg indexes must start at 0 and not skip any", argIndex))
+		}
+		argNames = append(argNames, argName)
+	}
+	// An Args field holds the raw remaining arguments, unless it is itself a
+	// positional argument or option field.
+	argsField, hasArgsField := reflectValue.Type().FieldByName("Args")
+	hasArgsField = hasArgsField && argsField.Tag.Get("arg") == "" && argsField.Tag.Get("option") == ""
+
+	// Build the usage synopsis from the options, positional arguments, and
+	// subcommands, such as "cmd [options] SOURCE [DEST...]".
+	usageParts := []string{name}
+	hasOptions := len(optionHelpData) > 0 || len(multilineOptionHelpData) > 0
+	for _, option := range inherited {
+		hasOptions = hasOptions || option.helpRow != nil
+	}
+	if hasOptions {
+		usageParts = append(usageParts, "[options]")
+	}
+	for _, argName := range append(append([]string{}, argNames...), argRest) {
+		if argName == "" {
+			continue
+		}
+		usagePart := argName
+		if argName == argRest {
+			usagePart += "..."
+		}
+		if !optionReqs[argName]["set"] {
+			usagePart = "[" + usagePart + "]"
+		}
+		usageParts = append(usageParts, usagePart)
+	}
+	if subcommands != nil {
+		usageParts = append(usageParts, "[subcommand]")
+	} else if len(argNames) == 0 && argRest == "" && hasArgsField {
+		usageParts = append(usageParts, "[args...]")
+	}
+	usage := strings.Join(usageParts, " ")
+
+	// usageError outputs the error, the usage line, and how to get more help
+	// to stderr, returning the exit code to use for usage errors.
+	usageError := func(err error) int {
+		fmt.Fprintln(stderr, err)
+		fmt.Fprintln(stderr, "Usage: "+usage)
+		for _, helpName := range []string{"--help", "-h", "-?"} {
+			if optionFields[helpName] == "HelpOption" {
+				fmt.Fprintf(stderr, "Try %q for more information.\n", name+" "+helpName)
+				break
+			}
+		}
+		if usageExitCode := resolveOption(reflectValue, "UsageExitCode"); usageExitCode.Kind() == reflect.Int && usageExitCode.Int() != 0 {
+			return int(usageExitCode.Int())
+		}
+		return ExitUsage
+	}
+
+	// Parse out the overall help text -- the top part without the options. If
+	// the help text doesn't include a usage line, we'll add one.
+	var helpText string
+	helpTemplate, err := template.New("help").Parse(reflectValue.FieldByName("Help").String())
+	if err != nil {
+		fmt.Fprintf(stderr, "Could not parse help text %q", reflectValue.FieldByName("Help").String())
+		panic(err)
+	}
+	var helpBuilder strings.Builder
+	if err := helpTemplate.Execute(&helpBuilder, map[string]interface{}{"Command": name, "Usage": usage}); err != nil {
+		fmt.Fprintf(stderr, "Could not parse help text %q", reflectValue.FieldByName("Help").String())
+		panic(err)
+	}
+	helpText = helpBuilder.String()
+	if !strings.Contains(helpText, "Usage:") {
+		helpText = "\nUsage: " + usage + "\n" + helpText
+	}
+	// relatedOptions turns an option's conflicts or requires tag into the
+	// full option names it refers to.
+	relatedOptions := func(optionName, tag string) []string {
+		var relatedNames []string
+		for _, relatedName := range strings.Split(optionTags[optionName].Get(tag), ",") {
+			if relatedName == "" {
+				continue
+			}
+			if len(relatedName) == 1 {
+				relatedName = "-" + relatedName
+			} else {
+				relatedName = "--" + relatedName
+			}
+			if _, ok := optionTypes[relatedName]; !ok {
+				panic(fmt.Sprintf("unknown option %q in %s tag for %s", relatedName, tag, optionFields[optionName]))
+			}
+			relatedNames = append(relatedNames, relatedName)
+		}
+		return relatedNames
+	}
+	for _, optionName := range optionNames {
+		relatedOptions(optionName, "conflicts")
+		relatedOptions(optionName, "requires")
+	}
+	// optionActive returns true if the option was set, only considering the
+	// command line if given is true, and is not just a false boolean.
+	// Inherited options are checked by the command they belong to.
+	optionActive := func(optionName string, given bool) bool {
+		if option, ok := inherited[optionName]; ok {
+			return option.active(given)
+		}
+		fieldName := optionFields[optionName]
+		if !optionsGiven[fieldName] && (given || !optionsSet[fieldName]) {
+			return false
+		}
+		if optionTypes[optionName] == "bool" {
+			reflectValue := optionValues[optionName]
+			if reflectValue.Kind() == reflect.Ptr {
+				reflectValue = reflectValue.Elem()
+			}
+			return reflectValue.Bool()
+		}
+		return true
+	}
+	// relationCheck ensures options given on the command line don't conflict
+	// with each other and that any options they require are also set, from
+	// the command line or otherwise.
+	relationCheck := func() error {
+		for _, optionName := range optionNames {
+			if !optionActive(optionName, true) {
+				continue
+			}
+			for _, relatedName := range relatedOptions(optionName, "conflicts") {
+				if optionActive(relatedName, true) {
+					return fmt.Errorf("option %q cannot be used with %q", optionName, relatedName)
 				}
-				setInt(optionValues[arg], v)
-			case "string":
-				if len(args) == i+1 {
-					fmt.Fprintf(stderr, "no value given for option %q\n", arg)
-					return 1
+			}
+			for _, relatedName := range relatedOptions(optionName, "requires") {
+				if !optionActive(relatedName, false) {
+					return fmt.Errorf("option %q requires %q", optionName, relatedName)
 				}
-				i++
-				if err := reqCheck(arg, args[i]); err != nil {
-					fmt.Fprintln(stderr, err)
-					return 1
+			}
+		}
+		return nil
+	}
+
+	// missing returns the names of any options and positional arguments
+	// required to be set, from the command line or a default, that weren't.
+	missing := func() ([]string, []string) {
+		var missingNames [2][]string
+		for k, names := range [][]string{optionNames, append(append([]string{}, argNames...), argRest)} {
+			for _, optionName := range names {
+				if optionName != "" && optionReqs[optionName]["set"] && !optionsGiven[optionFields[optionName]] && !optionsSet[optionFields[optionName]] {
+					missingNames[k] = append(missingNames[k], strconv.Quote(optionName))
 				}
-				setString(optionValues[arg], args[i])
+			}
+		}
+		return missingNames[0], missingNames[1]
+	}
+
+	// subcommandState returns the state for a subcommand, with us added to
+	// the ancestors and the persistent options being those we inherited,
+	// overridden by our own.
+	subcommandState := func(subcommandName string) *runState {
+		subcommandState := &runState{
+			ancestors:  append(append([]interface{}{}, state.ancestors...), cli),
+			persistent: map[string]*persistentOption{},
+			path:       append(append([]string{}, state.path...), subcommandName),
+			records:    state.records,
+			config:     append(append([]configEntry{}, state.config...), ownConfig...),
+			deferred:   append(append([]*deferredSteps{}, state.deferred...), &deferredSteps{applyDefaults: applyDefaults, missing: missing, relationCheck: relationCheck}),
+		}
+		for optionName, option := range inherited {
+			subcommandState.persistent[optionName] = option
+		}
+		for optionName, option := range ownPersistent {
+			subcommandState.persistent[optionName] = option
+		}
+		return subcommandState
+	}
+
+	// Scan the command line for options and remaining args, possibly switching
+	// context to a subcommand.
+	var remainingArgs []string
+	var remainingPositions []int
+	// noMore will be set true if we encounter a "--" alone; conventionally
+	// means "no more options follow".
+	noMore := false
+	// giveOption sets an option or positional argument from the command line,
+	// where source is its position there. The first time a slice option is
+	// given, any value it already had is discarded.
+	giveOption := func(optionName, value, source string) error {
+		if option, ok := inherited[optionName]; ok {
+			if err := option.give(optionName, value, source); err != nil {
+				return err
+			}
+			for _, copyField := range option.copies {
+				copyField.Set(option.value)
+			}
+			return nil
+		}
+		fieldName := optionFields[optionName]
+		if !optionsGiven[fieldName] && strings.HasPrefix(optionTypes[optionName], "[]") {
+			optionValues[optionName].Set(reflect.Zero(optionValues[optionName].Type()))
+		}
+		if err := setOption(optionName, value, ""); err != nil {
+			return err
+		}
+		optionsGiven[fieldName] = true
+		sources[fieldName] = source
+		return nil
+	}
+	// commandLineSource returns the source for our argument at index i,
+	// numbered as in os.Args.
+	commandLineSource := func(i int) string {
+		return fmt.Sprintf("command line argument %d", state.offset+i+1)
+	}
+	for optionName, option := range ownPersistent {
+		optionName := optionName
+		option.give = giveOption
+		option.active = func(given bool) bool {
+			return optionActive(optionName, given)
+		}
+	}
+	// applyArgs sets the positional argument fields, in order, from the
+	// remaining arguments, with any extras going to the rest field. Without
+	// any positional argument fields, the remaining arguments are left just
+	// for the Args field, if there is one.
+	applyArgs := func() error {
+		for k, value := range remainingArgs {
+			var argName string
+			switch {
+			case k < len(argNames):
+				argName = argNames[k]
+			case argRest != "":
+				argName = argRest
+			case len(argNames) == 0 && hasArgsField:
+				return nil
 			default:
+				return fmt.Errorf("unexpected argument %q", value)
+			}
+			if err := giveOption(argName, value, commandLineSource(remainingPositions[k])); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// shortCluster explodes an aggregate of short options like -abc into
+	// -a, -b, and -c. Only the last short option may take a value; if there
+	// are characters remaining after it they are returned as its value, as
+	// with -c3. If arg is not entirely made up of known short options, nil
+	// is returned.
+	shortCluster := func(arg string) ([]string, string, bool) {
+		var names []string
+		for k := 1; k < len(arg); k++ {
+			shortName := "-" + arg[k:k+1]
+			optionType, ok := optionTypes[shortName]
+			if !ok {
+				return nil, "", false
+			}
+			names = append(names, shortName)
+			if optionType != "bool" {
+				if k+1 < len(arg) {
+					return names, arg[k+1:], true
+				}
+				break
+			}
+		}
+		return names, "", false
+	}
+	// visibleOptionNames returns the names of all options that aren't hidden,
+	// including the --no- forms of long bool options.
+	visibleOptionNames := func() []string {
+		var names []string
+		for optionName, optionType := range optionTypes {
+			if optionName[0] != '-' || optionTags[optionName].Get("hidden") == "true" {
+				continue
+			}
+			names = append(names, optionName)
+			if optionType == "bool" && strings.HasPrefix(optionName, "--") {
+				names = append(names, "--no-"+optionName[2:])
+			}
+		}
+		return names
+	}
+	// abbreviations will be true if long options and subcommands may be given
+	// as any unique prefix of their names.
+	abbreviations := false
+	if allowAbbreviations := resolveOption(reflectValue, "AllowAbbreviations"); allowAbbreviations.Kind() == reflect.Bool {
+		abbreviations = allowAbbreviations.Bool()
+	}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		addArg := func() (bool, int) {
+			subcommandName, subcommand, ok := lookupSubcommand(arg)
+			if !ok && abbreviations && arg != "" {
+				// Aliases of the same subcommand aren't ambiguous.
+				var matches []string
+				matched := map[string]bool{}
+				for _, match := range prefixMatches(arg, visibleSubcommandNames()) {
+					if matchName, _, _ := lookupSubcommand(match); !matched[matchName] {
+						matched[matchName] = true
+						matches = append(matches, matchName)
+					}
+				}
+				if len(matches) == 1 {
+					subcommandName, subcommand, ok = lookupSubcommand(matches[0])
+				} else if len(matches) > 1 && len(argNames) == 0 && argRest == "" && !hasArgsField {
+					return true, usageError(fmt.Errorf("subcommand %q is ambiguous; could be %s", arg, quotedList(matches)))
+				}
+			}
+			if ok {
+				// Our own defaults are left to the subcommand, to be applied
+				// once its command line has been parsed.
+				if err := applyArgs(); err != nil {
+					return true, usageError(err)
+				}
+				nextState := subcommandState(subcommandName)
+				nextState.offset = state.offset + i + 1
+				return true, runSubcommand(ctx, stdout, stderr, nextState, name+" "+subcommandName, subcommand, args[i+1:])
+			}
+			// With nowhere else for the argument to go, it must have been
+			// meant as a subcommand.
+			if (subcommands != nil || hiddenSubcommands != nil) && len(argNames) == 0 && argRest == "" && !hasArgsField {
+				return true, usageError(fmt.Errorf("unknown subcommand %q%s", arg, didYouMean(arg, visibleSubcommandNames())))
+			}
+			remainingArgs = append(remainingArgs, arg)
+			remainingPositions = append(remainingPositions, i)
+			return false, 0
+		}
+		if noMore {
+			if ret, code := addArg(); ret {
+				return code
+			}
+			continue
+		}
+		if len(arg) > 1 && arg[0] == '-' {
+			// Split off any value given as part of the option itself, such as
+			// --option=value, unless the whole argument is already a known
+			// option.
+			var value string
+			hasValue := false
+			optionType, ok := optionTypes[arg]
+			if !ok {
+				if j := strings.IndexByte(arg, '='); j > 1 {
+					if optionType, ok = optionTypes[arg[:j]]; ok {
+						arg, value, hasValue = arg[:j], arg[j+1:], true
+					}
+				}
+			}
+			if !ok && arg[1] != '-' {
+				// Treat -abc as if it were -a -b -c, where the last short
+				// option may take a value, either attached as with -c3 or as
+				// the next argument as with -abc 3.
+				if names, clusterValue, clusterHasValue := shortCluster(arg); names != nil {
+					for _, shortName := range names[:len(names)-1] {
+						if err := giveOption(shortName, "true", commandLineSource(i)); err != nil {
+							return usageError(err)
+						}
+					}
+					arg = names[len(names)-1]
+					value, hasValue = clusterValue, clusterHasValue
+					optionType, ok = optionTypes[arg]
+				}
+			}
+			if !ok {
+				if j := strings.IndexByte(arg, '='); j > 1 {
+					arg, value, hasValue = arg[:j], arg[j+1:], true
+				}
+				// If we didn't find a match for the option, and it begins with
+				// just a single dash, try it with a double-dash for backward
+				// compatibility with Go's flag library which allows options
+				// like -version to mean the more standard --version option.
+				// Exploding aggregate short options above takes precedence
+				// over this.
+				if arg[1] != '-' {
+					arg = "-" + arg
+					optionType, ok = optionTypes[arg]
+				}
+				// If allowed, a long option may be abbreviated to any prefix
+				// that is unique, like --pre for --prefix.
+				if !ok && abbreviations {
+					var longNames []string
+					for _, optionName := range visibleOptionNames() {
+						if strings.HasPrefix(optionName, "--") {
+							longNames = append(longNames, optionName)
+						}
+					}
+					if matches := prefixMatches(arg, longNames); len(matches) > 0 {
+						// Several names for the same option, like --color
+						// and --colour, aren't ambiguous.
+						matchField := func(match string) string {
+							prefix := ""
+							if _, ok := optionTypes[match]; !ok {
+								prefix = "no "
+								match = "--" + strings.TrimPrefix(match, "--no-")
+							}
+							if option, ok := inherited[match]; ok {
+								return prefix + "persistent " + option.fieldName
+							}
+							return prefix + optionFields[match]
+						}
+						sameOption := true
+						for _, match := range matches[1:] {
+							if matchField(match) != matchField(matches[0]) {
+								sameOption = false
+							}
+						}
+						if !sameOption {
+							return usageError(fmt.Errorf("option %q is ambiguous; could be %s", arg, quotedList(matches)))
+						}
+						arg = matches[0]
+						optionType, ok = optionTypes[arg]
+					}
+				}
+				// If still didn't find a match for the option, and it happens
+				// to be --all-help, just pretend it was --help.
+				if !ok && arg == "--all-help" {
+					arg = "--help"
+					optionType = optionTypes[arg]
+				}
+			}
+			switch optionType {
+			case "":
 				if strings.HasPrefix(arg, "--no-") {
 					arg2 := "--" + arg[len("--no-"):]
 					if optionTypes[arg2] == "bool" {
-						setBool(optionValues[arg2], false)
+						if hasValue {
+							return usageError(fmt.Errorf("option %q does not take a value", arg))
+						}
+						if err := giveOption(arg2, "false", commandLineSource(i)); err != nil {
+							return usageError(err)
+						}
 						break
 					}
 				}
-				if arg == "--" {
+				if arg == "--" && !hasValue {
 					noMore = true
 					break
 				}
-				fmt.Fprintf(stderr, "unknown option %q\n", arg)
-				return 1
+				return usageError(fmt.Errorf("unknown option %q%s", arg, didYouMean(arg, visibleOptionNames())))
+			case "bool":
+				// Boolean options take no value from the next argument, but
+				// may be given one explicitly, as in --option=false.
+				if !hasValue {
+					value = "true"
+				}
+				if err := giveOption(arg, value, commandLineSource(i)); err != nil {
+					return usageError(err)
+				}
+			default:
+				source := commandLineSource(i)
+				if !hasValue {
+					if len(args) == i+1 {
+						return usageError(fmt.Errorf("no value given for option %q", arg))
+					}
+					i++
+					value = args[i]
+				}
+				if err := giveOption(arg, value, source); err != nil {
+					return usageError(err)
+				}
 			}
 		} else {
 			if ret, code := addArg(); ret {
@@ -483,7 +1490,29 @@ func runSubcommand(stdout FDWriter, stderr io.Writer, parent interface{}, name s
 			}
 		}
 	}
-	reflectValue.FieldByName("Args").Set(reflect.ValueOf(remainingArgs))
+	if err := applyArgs(); err != nil {
+		return usageError(err)
+	}
+	// Our ancestors' defaults are applied first, from the top-level command
+	// down, as the nearest config file and profile options are used for our
+	// own; the fields kept up to date with their persistent options then
+	// need refreshing.
+	for _, steps := range state.deferred {
+		if code := steps.applyDefaults(); code != 0 {
+			return code
+		}
+	}
+	for _, option := range state.persistent {
+		for _, copyField := range option.copies {
+			copyField.Set(option.value)
+		}
+	}
+	if code := applyDefaults(); code != 0 {
+		return code
+	}
+	if hasArgsField {
+		reflectValue.FieldByName("Args").Set(reflect.ValueOf(remainingArgs))
+	}
 
 	// Output the full help text, if asked.
 	helpFunc := func() {
@@ -493,11 +1522,21 @@ func runSubcommand(stdout FDWriter, stderr io.Writer, parent interface{}, name s
 		} else {
 			color = isatty.IsTerminal(stdout.Fd())
 		}
-		_, _ = stdout.Write(blackfridaytext.MarkdownToTextNoMetadata([]byte(helpText), &blackfridaytext.Options{Color: color, TableAlignOptions: brimtext.NewUnicodeBoxedAlignOptions()}))
+		width := writerWidth(stdout)
+		_, _ = stdout.Write(blackfridaytext.MarkdownToTextNoMetadata([]byte(helpText), &blackfridaytext.Options{Width: width - 1, Color: color, TableAlignOptions: brimtext.NewUnicodeBoxedAlignOptions()}))
 		alignOptions := brimtext.NewDefaultAlignOptions()
 		alignOptions.RowSecondUD = "    "
 		alignOptions.RowUD = "  "
-		alignOptions.Widths = []int{4, 0, brimtext.GetTTYWidth() - maxOptionLen - 8}
+		alignOptions.Widths = []int{4, 0, width - maxOptionLen - 8}
+		if profile := nearestField("ProfileOption"); profile != "" {
+			fmt.Fprintln(stdout)
+			fmt.Fprintf(stdout, "Active profile: %s\n", profile)
+		}
+		if len(argHelpData) > 0 {
+			fmt.Fprintln(stdout)
+			fmt.Fprintln(stdout, "Arguments:")
+			fmt.Fprint(stdout, brimtext.Align(argHelpData, alignOptions))
+		}
 		if len(optionHelpData) > 0 || len(multilineOptionHelpData) > 0 {
 			// Sort help and all-help to the top, dictionary order after that.
 			sort.Slice(optionHelpData, func(i, j int) bool {
@@ -521,33 +1560,65 @@ func runSubcommand(stdout FDWriter, stderr io.Writer, parent interface{}, name s
 			for _, helpData := range multilineOptionHelpData {
 				optionHelpData = append(optionHelpData, nil, helpData)
 			}
-			fmt.Println()
-			fmt.Println("Options:")
-			fmt.Print(brimtext.Align(optionHelpData, alignOptions))
+			fmt.Fprintln(stdout)
+			fmt.Fprintln(stdout, "Options:")
+			fmt.Fprint(stdout, brimtext.Align(optionHelpData, alignOptions))
+		}
+		// List the persistent options inherited from our ancestors, in
+		// dictionary order.
+		var globalOptionHelpData [][]string
+		var multilineGlobalOptionHelpData [][]string
+		listed := map[*persistentOption]bool{}
+		for _, option := range inherited {
+			if option.helpRow != nil && !listed[option] {
+				listed[option] = true
+				if strings.Contains(option.helpRow[1], "\n") {
+					multilineGlobalOptionHelpData = append(multilineGlobalOptionHelpData, option.helpRow)
+				} else {
+					globalOptionHelpData = append(globalOptionHelpData, option.helpRow)
+				}
+			}
+		}
+		if len(globalOptionHelpData) > 0 || len(multilineGlobalOptionHelpData) > 0 {
+			for _, helpData := range [][][]string{globalOptionHelpData, multilineGlobalOptionHelpData} {
+				sort.Slice(helpData, func(i, j int) bool {
+					return strings.ToLower(strings.TrimLeft(helpData[i][1], "-")) < strings.ToLower(strings.TrimLeft(helpData[j][1], "-"))
+				})
+			}
+			for _, helpData := range multilineGlobalOptionHelpData {
+				globalOptionHelpData = append(globalOptionHelpData, nil, helpData)
+			}
+			fmt.Fprintln(stdout)
+			fmt.Fprintln(stdout, "Global options:")
+			fmt.Fprint(stdout, brimtext.Align(globalOptionHelpData, alignOptions))
 		}
 		if subcommands != nil {
-			fmt.Println()
-			fmt.Println("Subcommands:")
+			fmt.Fprintln(stdout)
+			fmt.Fprintln(stdout, "Subcommands:")
 			var subcommandNames []string
-			maxSubcommandLen := 0
 			for subcommandName := range subcommands {
-				if len(subcommandName) > maxSubcommandLen {
-					maxSubcommandLen = len(subcommandName)
-				}
 				subcommandNames = append(subcommandNames, subcommandName)
 			}
 			sort.Strings(subcommandNames)
 			var subcommandHelpData [][]string
+			maxSubcommandLen := 0
 			for _, subcommandName := range subcommandNames {
 				subcommandReflectValue := reflect.ValueOf(subcommands[subcommandName])
 				if subcommandReflectValue.Kind() == reflect.Ptr {
 					subcommandReflectValue = subcommandReflectValue.Elem()
 				}
 				subcommandHelpText := subcommandReflectValue.FieldByName("QuickHelp").String()
+				// Aliases are listed beside the name, as in "remove (rm)".
+				if aliases := aliasesOf(subcommands[subcommandName]); len(aliases) > 0 {
+					subcommandName += " (" + strings.Join(aliases, ", ") + ")"
+				}
+				if len(subcommandName) > maxSubcommandLen {
+					maxSubcommandLen = len(subcommandName)
+				}
 				subcommandHelpData = append(subcommandHelpData, []string{"", subcommandName, subcommandHelpText})
 			}
-			alignOptions.Widths = []int{4, maxSubcommandLen, brimtext.GetTTYWidth() - maxOptionLen - 7}
-			fmt.Print(brimtext.Align(subcommandHelpData, alignOptions))
+			alignOptions.Widths = []int{4, maxSubcommandLen, width - maxOptionLen - 7}
+			fmt.Fprint(stdout, brimtext.Align(subcommandHelpData, alignOptions))
 		}
 	}
 	if allHelpOption := reflectValue.FieldByName("AllHelpOption"); allHelpOption.Kind() == reflect.Bool && allHelpOption.Bool() {
@@ -557,26 +1628,207 @@ func runSubcommand(stdout FDWriter, stderr io.Writer, parent interface{}, name s
 			subcommandNames = append(subcommandNames, subcommandName)
 		}
 		sort.Strings(subcommandNames)
+		// The same subcommand registered under more than one name only needs
+		// its help output once.
+		seen := map[uintptr]bool{}
 		for _, subcommandName := range subcommandNames {
+			if subcommandReflectValue := reflect.ValueOf(subcommands[subcommandName]); subcommandReflectValue.Kind() == reflect.Ptr {
+				if seen[subcommandReflectValue.Pointer()] {
+					continue
+				}
+				seen[subcommandReflectValue.Pointer()] = true
+			}
 			fmt.Fprintln(stdout)
 			fmt.Fprintln(stdout)
 			fmt.Fprintln(stdout)
 			s := "---[ " + name + " " + subcommandName + " ]"
 			fmt.Fprint(stdout, s)
-			fmt.Fprintln(stdout, strings.Repeat("-", brimtext.GetTTYWidth()-len(s)-1))
+			fmt.Fprintln(stdout, strings.Repeat("-", writerWidth(stdout)-len(s)-1))
 			fmt.Fprintln(stdout)
-			runSubcommand(stdout, stderr, cli, name+" "+subcommandName, subcommands[subcommandName], []string{"--all-help"})
+			runSubcommand(ctx, stdout, stderr, subcommandState(subcommandName), name+" "+subcommandName, subcommands[subcommandName], []string{"--all-help"})
 		}
-		return 1
+		return ExitOK
 	}
 	if helpOption := reflectValue.FieldByName("HelpOption"); helpOption.Kind() == reflect.Bool && helpOption.Bool() {
 		helpFunc()
-		return 1
+		return ExitOK
+	}
+
+	// Output a table of each option's value and where it came from, if asked
+	// by an ExplainOption field of ours or of any of our ancestors.
+	explain := false
+	for _, command := range append(append([]interface{}{}, state.ancestors...), cli) {
+		if explainOption := reflect.Indirect(reflect.ValueOf(command)).FieldByName("ExplainOption"); explainOption.Kind() == reflect.Bool && explainOption.Bool() {
+			explain = true
+		}
+	}
+	if explain {
+		explainData := [][]string{{"Option", "Value", "Source"}}
+		for _, optionName := range append(append(append([]string{}, optionNames...), argNames...), argRest) {
+			switch optionFields[optionName] {
+			case "", "HelpOption", "AllHelpOption", "ExplainOption", "DumpConfigOption":
+				continue
+			}
+			if optionTags[optionName].Get("hidden") == "true" {
+				continue
+			}
+			value := strings.Join(formatValues(optionValues[optionName]), ", ")
+			if optionTags[optionName].Get("secret") == "true" {
+				value = "(secret)"
+			}
+			explainData = append(explainData, []string{longName(optionName, optionTags[optionName]), value, sources[optionFields[optionName]]})
+		}
+		// Inherited persistent options are listed by their long names, in
+		// dictionary order.
+		var inheritedData [][]string
+		for optionName, option := range inherited {
+			if option.fieldName == "ExplainOption" || option.fieldName == "DumpConfigOption" || option.tag.Get("hidden") == "true" {
+				continue
+			}
+			if optionName != longName(optionName, option.tag) {
+				continue
+			}
+			value := strings.Join(formatValues(option.value), ", ")
+			if option.tag.Get("secret") == "true" {
+				value = "(secret)"
+			}
+			inheritedData = append(inheritedData, []string{optionName, value, option.sources[option.fieldName]})
+		}
+		sort.Slice(inheritedData, func(i, j int) bool {
+			return strings.ToLower(strings.TrimLeft(inheritedData[i][0], "-")) < strings.ToLower(strings.TrimLeft(inheritedData[j][0], "-"))
+		})
+		alignOptions := brimtext.NewDefaultAlignOptions()
+		alignOptions.RowSecondUD = "  "
+		alignOptions.RowUD = "  "
+		fmt.Fprint(stdout, brimtext.Align(append(explainData, inheritedData...), alignOptions))
+		return ExitOK
+	}
+
+	// Output the effective values of our options and our ancestors' as a
+	// config file instead of running, if asked by a DumpConfigOption field
+	// of ours or of any of our ancestors. A bool field gives JSON, and a
+	// string field names the format, "json" or "ini".
+	dumpFormat := ""
+	for _, command := range append(append([]interface{}{}, state.ancestors...), cli) {
+		switch dumpConfigOption := reflect.Indirect(reflect.ValueOf(command)).FieldByName("DumpConfigOption"); dumpConfigOption.Kind() {
+		case reflect.Bool:
+			if dumpConfigOption.Bool() {
+				dumpFormat = "json"
+			}
+		case reflect.String:
+			if dumpConfigOption.String() != "" {
+				dumpFormat = dumpConfigOption.String()
+			}
+		}
+	}
+	if dumpFormat != "" {
+		if dumpFormat != "json" && dumpFormat != "ini" {
+			return usageError(fmt.Errorf("unknown config format %q; must be one of: json, ini", dumpFormat))
+		}
+		if err := dumpConfig(stdout, dumpFormat, append(append([]configEntry{}, state.config...), ownConfig...)); err != nil {
+			fmt.Fprintln(stderr, err)
+			return ExitFailure
+		}
+		return ExitOK
+	}
+
+	// Ensure any options required to be set were, either from the command
+	// line or a default, including those of our ancestors.
+	var missingOptions, missingArguments []string
+	allSteps := append(append([]*deferredSteps{}, state.deferred...), &deferredSteps{missing: missing, relationCheck: relationCheck})
+	for _, steps := range allSteps {
+		options, arguments := steps.missing()
+		missingOptions = append(missingOptions, options...)
+		missingArguments = append(missingArguments, arguments...)
+	}
+	var missingText []string
+	for _, names := range []struct {
+		singular, plural string
+		names            []string
+	}{{"option", "options", missingOptions}, {"argument", "arguments", missingArguments}} {
+		if len(names.names) == 1 {
+			missingText = append(missingText, names.singular+" "+names.names[0])
+		} else if len(names.names) > 1 {
+			missingText = append(missingText, names.plural+" "+strings.Join(names.names, ", "))
+		}
+	}
+	if len(missingText) > 0 {
+		return usageError(fmt.Errorf("missing required %s", strings.Join(missingText, " and ")))
+	}
+	// Our ancestors' options are checked by their own relationCheck, as
+	// persistent options they own may have been given on our command line.
+	for _, steps := range allSteps {
+		if err := steps.relationCheck(); err != nil {
+			return usageError(err)
+		}
 	}
 
-	// Actually Run!
-	exitCode := int(reflectValue.FieldByName("Func").Call([]reflect.Value{reflect.ValueOf(cli)})[0].Int())
-	if exitCode == 1 {
+	// Actually Run! Any PersistentBefore hooks from the top-level command
+	// down to us are called first, then our Before hook, and then Func. The
+	// After hooks are called in the reverse order, even if something panics,
+	// but only for those commands whose Before hooks were reached and didn't
+	// abort with a non-zero exit code.
+	//
+	// An error returned by any of them is output to stderr, giving
+	// ExitFailure or the code from an ExitCoder, unless it is from the
+	// context being canceled, such as by an interrupt signal, which gives
+	// ExitInterrupted. ErrShowHelp outputs the full help text instead, and
+	// errors from UsageError are treated like command line errors.
+	// showHelp will be set true for ErrShowHelp or if Func returns
+	// ExitFailure itself.
+	showHelp := false
+	funcExit := func(exitCode int, err error) int {
+		if err == nil {
+			return exitCode
+		}
+		if errors.Is(err, context.Canceled) && ctx.Err() == context.Canceled {
+			return ExitInterrupted
+		}
+		var commandLineErr commandLineError
+		if errors.As(err, &commandLineErr) {
+			return usageError(commandLineErr.error)
+		}
+		exitCode = ExitFailure
+		var exitCoder ExitCoder
+		if errors.As(err, &exitCoder) {
+			exitCode = exitCoder.ExitCode()
+		}
+		if errors.Is(err, ErrShowHelp) {
+			showHelp = true
+		} else if err.Error() != "" {
+			fmt.Fprintln(stderr, err)
+		}
+		return exitCode
+	}
+	var run func(commands []interface{}) int
+	run = func(commands []interface{}) (exitCode int) {
+		if len(commands) == 0 {
+			if exitCode = funcExit(callFunc(ctx, cli, "Before")); exitCode != ExitOK {
+				return exitCode
+			}
+			defer func() {
+				if afterExitCode := funcExit(callFunc(ctx, cli, "After")); exitCode == ExitOK {
+					exitCode = afterExitCode
+				}
+			}()
+			funcExitCode, err := callFunc(ctx, cli, "Func")
+			if err == nil && funcExitCode == ExitFailure {
+				showHelp = true
+			}
+			return funcExit(funcExitCode, err)
+		}
+		if exitCode = funcExit(callFunc(ctx, commands[0], "PersistentBefore")); exitCode != ExitOK {
+			return exitCode
+		}
+		defer func() {
+			if afterExitCode := funcExit(callFunc(ctx, commands[0], "PersistentAfter")); exitCode == ExitOK {
+				exitCode = afterExitCode
+			}
+		}()
+		return run(commands[1:])
+	}
+	exitCode := run(append(append([]interface{}{}, state.ancestors...), cli))
+	if showHelp {
 		helpFunc()
 	}
 	return exitCode
@@ -600,44 +1852,906 @@ func resolveOption(reflectValue reflect.Value, name string) reflect.Value {
 	return rv
 }
 
+// Value is the interface to implement for custom option types, for when
+// encoding.TextUnmarshaler isn't enough. Set is given the option's value from
+// the command line or a default, String returns the current value, and Type
+// returns a short word for the kind of value, shown in the help text such as
+// "--log-level level".
+//
+// Like encoding.TextUnmarshaler, it is the pointer to the option's type that
+// should implement the interface, and each value is Set on a new zero value
+// of the type.
+type Value interface {
+	Set(value string) error
+	String() string
+	Type() string
+}
+
+var valueType = reflect.TypeOf((*Value)(nil)).Elem()
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// integerBase returns the integer text and the base to give strconv for it.
+// Only an explicit 0x, 0o, or 0b prefix selects another base; otherwise the
+// text is decimal, even with leading zeros, and any _ separators are removed.
+func integerBase(value string) (string, int) {
+	digits := strings.TrimLeft(value, "+-")
+	if len(digits) > 1 && digits[0] == '0' {
+		switch digits[1] {
+		case 'x', 'X', 'o', 'O', 'b', 'B':
+			return value, 0
+		}
+	}
+	return strings.Replace(value, "_", "", -1), 10
+}
+
+// compareValues returns -1, 0, or 1 as the parsed numeric value a is less
+// than, equal to, or greater than b, which must be of the same kind.
+func compareValues(a, b reflect.Value) int {
+	switch a.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		switch {
+		case a.Int() < b.Int():
+			return -1
+		case a.Int() > b.Int():
+			return 1
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		switch {
+		case a.Uint() < b.Uint():
+			return -1
+		case a.Uint() > b.Uint():
+			return 1
+		}
+	case reflect.Float32, reflect.Float64:
+		switch {
+		case a.Float() < b.Float():
+			return -1
+		case a.Float() > b.Float():
+			return 1
+		}
+	default:
+		panic(fmt.Sprintln("sealeye programmer error [4]", a.Kind()))
+	}
+	return 0
+}
+
+// ExitCoder is an error that also specifies the exit code to use when it is
+// returned from a Func or hook. See Exit for an easy way to make one.
+type ExitCoder interface {
+	error
+	ExitCode() int
+}
+
+// Exit returns an error that gives the exit code when returned from a Func or
+// hook. If err is nil, nothing will be output to stderr.
+//
+//  if err := doSomething(); err != nil {
+//  	return sealeye.Exit(3, err)
+//  }
+func Exit(code int, err error) error {
+	return &exitError{code: code, err: err}
+}
+
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	if e.err == nil {
+		return ""
+	}
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+func (e *exitError) ExitCode() int {
+	return e.code
+}
+
+// ErrShowHelp may be returned from a Func or hook to have the full help text
+// output, exiting with ExitFailure; use Exit to give a different code.
+var ErrShowHelp = errors.New("show help")
+
+// UsageError returns an error that, when returned from a Func or hook, is
+// treated as if it were a problem found with the command line: err is output
+// to stderr along with the usage line, exiting with ExitUsage.
+//
+//  if cli.Start > cli.End {
+//  	return sealeye.UsageError(fmt.Errorf("--start must come before --end"))
+//  }
+func UsageError(err error) error {
+	return commandLineError{err}
+}
+
+type commandLineError struct {
+	error
+}
+
+func (e commandLineError) Unwrap() error {
+	return e.error
+}
+
+// callFunc calls the command's function field by the given name, such as
+// "Func" or "Before", if it has one. It is passed the command, preceded by the
+// context if it takes a context.Context first. It may return an exit code, an
+// error, or nothing at all, which is treated as ExitOK.
+func callFunc(ctx context.Context, command interface{}, funcName string) (int, error) {
+	reflectValue := reflect.ValueOf(command)
+	if reflectValue.Kind() == reflect.Ptr {
+		reflectValue = reflectValue.Elem()
+	}
+	fn := reflectValue.FieldByName(funcName)
+	if fn.Kind() != reflect.Func || fn.IsNil() {
+		return ExitOK, nil
+	}
+	in := []reflect.Value{reflect.ValueOf(command)}
+	if fn.Type().NumIn() == 2 && fn.Type().In(0) == contextType {
+		in = append([]reflect.Value{reflect.ValueOf(ctx)}, in...)
+		if interrupts, ok := ctx.Value(interruptKey{}).(*interruptState); ok {
+			atomic.AddInt32(&interrupts.listening, 1)
+			defer atomic.AddInt32(&interrupts.listening, -1)
+		}
+	}
+	results := fn.Call(in)
+	if len(results) == 0 {
+		return ExitOK, nil
+	}
+	if results[0].Type() == errorType {
+		err, _ := results[0].Interface().(error)
+		return ExitOK, err
+	}
+	return int(results[0].Int()), nil
+}
+
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// configFile holds the values from a JSON or INI config file, by section and
+// then key. Sections are subcommand paths, like "cat" or "cat.sub", with ""
+// for the top-level command. Named profiles are in sections prefixed with
+// "profiles." such as "profiles.staging" and "profiles.staging.cat"; once
+// chosen with useProfile, their values take precedence over the others.
+type configFile struct {
+	sections map[string]map[string]*configValue
+	profiles []string
+	// lower holds the config files merged into this one, in order of
+	// decreasing precedence.
+	lower []*configFile
+}
+
+// files returns the config file followed by those merged into it.
+func (config *configFile) files() []*configFile {
+	return append([]*configFile{config}, config.lower...)
+}
+
+// useProfile has lookup use the profile's sections first, followed by those of
+// any profile it inherits from with an "inherit" key, and so on.
+func (config *configFile) useProfile(profile string) error {
+	config.profiles = nil
+	for name := profile; name != ""; {
+		for _, used := range config.profiles {
+			if used == name {
+				return fmt.Errorf("profile %q inherits from itself", name)
+			}
+		}
+		var inherit *configValue
+		found := false
+		for _, file := range config.files() {
+			if section, ok := file.sections["profiles."+name]; ok {
+				found = true
+				if inherit == nil {
+					inherit = section["inherit"]
+				}
+			}
+		}
+		if !found {
+			if name == profile {
+				return fmt.Errorf("unknown profile %q", name)
+			}
+			return fmt.Errorf("unknown profile %q inherited by profile %q", name, config.profiles[len(config.profiles)-1])
+		}
+		config.profiles = append(config.profiles, name)
+		name = ""
+		if inherit != nil {
+			name = inherit.values[0]
+		}
+	}
+	return nil
+}
+
+// configValue is a value from a config file; more than one value is only
+// valid for repeatable options. The where text describes the location for
+// error messages, such as `app.json key "cat.count"` or "app.ini:12", and dir
+// is the directory of the config file.
+type configValue struct {
+	values []string
+	where  string
+	dir    string
+}
+
+// merge adds the other config file with a lower precedence, so lookup only
+// uses its value for an option if no file before it has one under any of the
+// option's keys.
+func (config *configFile) merge(other *configFile) {
+	config.lower = append(config.lower, other)
+}
+
+// discoverConfigFiles returns the existing config files for the name, in
+// order of precedence: the nearest .name.json or .name.ini in the current
+// directory or any parent, then config.json or config.ini in the user's
+// $XDG_CONFIG_HOME/name directory (defaulting to ~/.config/name), then those
+// in /etc/name.
+func discoverConfigFiles(name string) []string {
+	var configPaths []string
+	found := func(dir string, baseNames ...string) bool {
+		for _, baseName := range baseNames {
+			configPath := filepath.Join(dir, baseName)
+			if fi, err := os.Stat(configPath); err == nil && !fi.IsDir() {
+				configPaths = append(configPaths, configPath)
+				return true
+			}
+		}
+		return false
+	}
+	if dir, err := os.Getwd(); err == nil {
+		for !found(dir, "."+name+".json", "."+name+".ini") {
+			parent := filepath.Dir(dir)
+			if parent == dir {
+				break
+			}
+			dir = parent
+		}
+	}
+	userDir := os.Getenv("XDG_CONFIG_HOME")
+	if userDir == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			userDir = filepath.Join(home, ".config")
+		}
+	}
+	if userDir != "" {
+		found(filepath.Join(userDir, name), "config.json", "config.ini")
+	}
+	found(filepath.Join("/etc", name), "config.json", "config.ini")
+	return configPaths
+}
+
+// lookup returns the first value found in the section for the path using any
+// of the keys, or nil if none are found. The sections of any profiles in use
+// are checked first, and each section is checked in every file in order of
+// precedence.
+func (config *configFile) lookup(path []string, keys []string) *configValue {
+	var sectionNames []string
+	for _, profile := range config.profiles {
+		sectionNames = append(sectionNames, strings.Join(append([]string{"profiles", profile}, path...), "."))
+	}
+	sectionNames = append(sectionNames, strings.Join(path, "."))
+	for _, sectionName := range sectionNames {
+		for _, file := range config.files() {
+			section := file.sections[sectionName]
+			for _, key := range keys {
+				if value := section[key]; value != nil {
+					return value
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// loadConfigFile reads the JSON or INI file; it is assumed to be JSON if it
+// has a .json extension or begins with a "{".
+func loadConfigFile(path string) (*configFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &configFile{sections: map[string]map[string]*configValue{}}
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(filepath.Ext(path), ".json") || strings.HasPrefix(strings.TrimSpace(string(data)), "{") {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		var object map[string]interface{}
+		if err := decoder.Decode(&object); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		if err := config.addJSON(path, dir, "", object); err != nil {
+			return nil, err
+		}
+		return config, nil
+	}
+	section := ""
+	config.sections[section] = map[string]*configValue{}
+	for lineNumber, line := range strings.Split(string(data), "\n") {
+		where := fmt.Sprintf("%s:%d", path, lineNumber+1)
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			if line[len(line)-1] != ']' {
+				return nil, fmt.Errorf("%s: invalid section %q", where, line)
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			if config.sections[section] == nil {
+				config.sections[section] = map[string]*configValue{}
+			}
+			continue
+		}
+		i := strings.IndexByte(line, '=')
+		if i < 1 {
+			return nil, fmt.Errorf("%s: expected key = value", where)
+		}
+		key := strings.TrimSpace(line[:i])
+		value := strings.TrimSpace(line[i+1:])
+		if len(value) > 1 && value[0] == '"' {
+			if value, err = strconv.Unquote(value); err != nil {
+				return nil, fmt.Errorf("%s: invalid quoted value for key %q", where, key)
+			}
+		}
+		// Repeating a key gives a repeatable option more values; its
+		// location for error messages remains the first line.
+		if existing := config.sections[section][key]; existing != nil {
+			existing.values = append(existing.values, value)
+		} else {
+			fullKey := key
+			if section != "" {
+				fullKey = section + "." + key
+			}
+			where = fmt.Sprintf("%s key %q", where, fullKey)
+			config.sections[section][key] = &configValue{values: []string{value}, where: where, dir: dir}
+		}
+	}
+	return config, nil
+}
+
+// addJSON adds the values from the JSON object as the section; any nested
+// objects are the sections for subcommands.
+func (config *configFile) addJSON(path, dir, section string, object map[string]interface{}) error {
+	if config.sections[section] == nil {
+		config.sections[section] = map[string]*configValue{}
+	}
+	for key, value := range object {
+		fullKey := key
+		if section != "" {
+			fullKey = section + "." + key
+		}
+		where := fmt.Sprintf("%s key %q", path, fullKey)
+		var values []string
+		switch value := value.(type) {
+		case nil:
+			continue
+		case map[string]interface{}:
+			if err := config.addJSON(path, dir, fullKey, value); err != nil {
+				return err
+			}
+			continue
+		case []interface{}:
+			for _, item := range value {
+				itemValue, ok := jsonScalar(item)
+				if !ok {
+					return fmt.Errorf("%s: unsupported value in list", where)
+				}
+				values = append(values, itemValue)
+			}
+		default:
+			itemValue, ok := jsonScalar(value)
+			if !ok {
+				return fmt.Errorf("%s: unsupported value", where)
+			}
+			values = []string{itemValue}
+		}
+		config.sections[section][key] = &configValue{values: values, where: where, dir: dir}
+	}
+	return nil
+}
+
+// jsonScalar returns the string form of the JSON string, number, or boolean.
+func jsonScalar(value interface{}) (string, bool) {
+	switch value := value.(type) {
+	case string:
+		return value, true
+	case json.Number:
+		return value.String(), true
+	case bool:
+		return strconv.FormatBool(value), true
+	}
+	return "", false
+}
+
+// configEntry is an option as it would be in a config file, in the section
+// for the path and with the key. If absolute is true, the option is required
+// to be a file or directory, and relative paths are made absolute so they
+// don't become relative to the config file's directory.
+type configEntry struct {
+	path       []string
+	key        string
+	optionType string
+	value      reflect.Value
+	absolute   bool
+}
+
+// dumpConfig writes the entries' values as a JSON or INI config file, in the
+// form loadConfigFile reads. Options without a value, such as nil pointers
+// and empty paths, are left out.
+func dumpConfig(w io.Writer, format string, entries []configEntry) error {
+	type valuesEntry struct {
+		configEntry
+		values []string
+	}
+	var valuesEntries []valuesEntry
+	for _, entry := range entries {
+		if entry.value.Kind() == reflect.Ptr && entry.value.IsNil() {
+			continue
+		}
+		values := formatValues(entry.value)
+		if entry.absolute {
+			// An empty path would fail the requirement when read back, so
+			// it is left out, as if it were never set.
+			var absValues []string
+			for _, value := range values {
+				if value == "" {
+					continue
+				}
+				if !filepath.IsAbs(value) {
+					if absValue, err := filepath.Abs(value); err == nil {
+						value = absValue
+					}
+				}
+				absValues = append(absValues, value)
+			}
+			if len(absValues) == 0 && !strings.HasPrefix(entry.optionType, "[]") {
+				continue
+			}
+			values = absValues
+		}
+		valuesEntries = append(valuesEntries, valuesEntry{entry, values})
+	}
+	if format == "json" {
+		object := map[string]interface{}{}
+		for _, entry := range valuesEntries {
+			section := object
+			for _, name := range entry.path {
+				subsection, ok := section[name].(map[string]interface{})
+				if !ok {
+					subsection = map[string]interface{}{}
+					section[name] = subsection
+				}
+				section = subsection
+			}
+			items := []interface{}{}
+			for _, value := range entry.values {
+				switch strings.TrimPrefix(entry.optionType, "[]") {
+				case "bool":
+					items = append(items, value == "true")
+				case "int", "int8", "int16", "int32", "int64", "uint", "uint8", "uint16", "uint32", "uint64", "float32", "float64":
+					items = append(items, json.Number(value))
+				default:
+					items = append(items, value)
+				}
+			}
+			if strings.HasPrefix(entry.optionType, "[]") {
+				section[entry.key] = items
+			} else if len(items) > 0 {
+				section[entry.key] = items[0]
+			}
+		}
+		data, err := json.MarshalIndent(object, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", data)
+		return err
+	}
+	// INI has no way to give an empty list, so an empty repeatable option is
+	// left out; strings are quoted if they wouldn't otherwise read back the
+	// same.
+	sections := map[string][]string{}
+	for _, entry := range valuesEntries {
+		sectionName := strings.Join(entry.path, ".")
+		for _, value := range entry.values {
+			if value != strings.TrimSpace(value) || strings.HasPrefix(value, "\"") || strings.ContainsAny(value, "\r\n") {
+				value = strconv.Quote(value)
+			}
+			sections[sectionName] = append(sections[sectionName], entry.key+" = "+value)
+		}
+	}
+	var sectionNames []string
+	for sectionName := range sections {
+		sectionNames = append(sectionNames, sectionName)
+	}
+	sort.Strings(sectionNames)
+	var b strings.Builder
+	for _, sectionName := range sectionNames {
+		if b.Len() > 0 {
+			b.WriteString("\n")
+		}
+		if sectionName != "" {
+			b.WriteString("[" + sectionName + "]\n")
+		}
+		for _, line := range sections[sectionName] {
+			b.WriteString(line + "\n")
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// persistentOption is an option marked persistent:"true", which the command's
+// subcommands, and theirs, also accept.
+type persistentOption struct {
+	optionType string
+	fieldName  string
+	tag        reflect.StructTag
+	// value is the option's field in the command it belongs to, and give
+	// sets it as if given on that command's command line.
+	value reflect.Value
+	give  func(optionName, value, source string) error
+	// active returns true if the option was set, as for a conflicts or
+	// requires tag, only considering the command line if given is true.
+	active func(given bool) bool
+	// sources are the sources for the fields of the command it belongs to.
+	sources map[string]string
+	// copies are the fields of the same name in subcommands, kept up to date
+	// with the option's value.
+	copies []reflect.Value
+	// helpRow is the option's entry in the options table, or nil if hidden,
+	// and helpLen the length of its longest name in that entry.
+	helpRow []string
+	helpLen int
+}
+
+// Source returns where the field of the command got its value, such as
+// "command line argument 2" (numbered as in os.Args), "$COUNT" for an
+// environment variable, "default" for a literal default, "terminal" for the
+// "terminal" default, or the config file location such as "app.ini:12". For a
+// field kept up to date with an ancestor's persistent option, it is the
+// source of that option.
+//
+// Sources are only kept while the command is running, so Source is meant to
+// be called from the Func or hooks of the command or its subcommands. If the
+// field wasn't set at all, or the command isn't running, "" is returned.
+//
+//  fmt.Println("count", cli.Count, "from", sealeye.Source(cli, "Count"))
+func Source(cli interface{}, fieldName string) string {
+	commandSources.Lock()
+	record := commandSources.records[cli]
+	commandSources.Unlock()
+	if record == nil {
+		return ""
+	}
+	if option := record.copies[fieldName]; option != nil {
+		return option.sources[option.fieldName]
+	}
+	return record.sources[fieldName]
+}
+
+// sourcesRecord is what Source uses for a command: the sources of its fields,
+// and the persistent options its copy fields are kept up to date with.
+type sourcesRecord struct {
+	cli     interface{}
+	sources map[string]string
+	copies  map[string]*persistentOption
+}
+
+var commandSources = struct {
+	sync.Mutex
+	records map[interface{}]*sourcesRecord
+}{records: map[interface{}]*sourcesRecord{}}
+
+// recordSources starts a new record of the command's sources for Source,
+// adding it to the run's records.
+func recordSources(records *[]*sourcesRecord, cli interface{}, sources map[string]string) *sourcesRecord {
+	record := &sourcesRecord{cli: cli, sources: sources, copies: map[string]*persistentOption{}}
+	if reflect.TypeOf(cli).Comparable() {
+		commandSources.Lock()
+		commandSources.records[cli] = record
+		commandSources.Unlock()
+		*records = append(*records, record)
+	}
+	return record
+}
+
+// forgetSources removes the records, unless they have since been replaced by
+// another run of the same command.
+func forgetSources(records []*sourcesRecord) {
+	commandSources.Lock()
+	for _, record := range records {
+		if commandSources.records[record.cli] == record {
+			delete(commandSources.records, record.cli)
+		}
+	}
+	commandSources.Unlock()
+}
+
+// formatValues returns the option's value as text, as it could be given on
+// the command line; slices give each of their values and nil pointers none.
+func formatValues(reflectValue reflect.Value) []string {
+	if reflectValue.CanAddr() {
+		switch v := reflectValue.Addr().Interface().(type) {
+		case Value:
+			return []string{v.String()}
+		case encoding.TextMarshaler:
+			if text, err := v.MarshalText(); err == nil {
+				return []string{string(text)}
+			}
+		}
+	}
+	switch reflectValue.Kind() {
+	case reflect.Ptr:
+		if reflectValue.IsNil() {
+			return nil
+		}
+		return formatValues(reflectValue.Elem())
+	case reflect.Slice:
+		var values []string
+		for i := 0; i < reflectValue.Len(); i++ {
+			values = append(values, formatValues(reflectValue.Index(i))...)
+		}
+		return values
+	}
+	if v, ok := reflectValue.Interface().(fmt.Stringer); ok {
+		return []string{v.String()}
+	}
+	return []string{fmt.Sprint(reflectValue.Interface())}
+}
+
+// aliasesOf returns the contents of the subcommand's Aliases field, if it has
+// one.
+func aliasesOf(subcommand interface{}) []string {
+	reflectValue := reflect.ValueOf(subcommand)
+	if reflectValue.Kind() == reflect.Ptr {
+		reflectValue = reflectValue.Elem()
+	}
+	if reflectValue.Kind() != reflect.Struct {
+		return nil
+	}
+	if aliasesField := reflectValue.FieldByName("Aliases"); aliasesField.Kind() != reflect.Invalid {
+		aliases, _ := aliasesField.Interface().([]string)
+		return aliases
+	}
+	return nil
+}
+
+// didYouMean returns a suggestion like `; did you mean "--prefix"?` listing
+// the candidates closest to the mistyped word, or "" if none are close
+// enough. Leading dashes are ignored when comparing.
+func didYouMean(word string, candidates []string) string {
+	trimmed := strings.TrimLeft(word, "-")
+	best := (utf8.RuneCountInString(trimmed) + 1) / 3
+	var closest []string
+	for _, candidate := range candidates {
+		distance := editDistance(trimmed, strings.TrimLeft(candidate, "-"))
+		if distance < best {
+			best = distance
+			closest = nil
+		}
+		if distance == best {
+			closest = append(closest, candidate)
+		}
+	}
+	if best == 0 || len(closest) == 0 {
+		return ""
+	}
+	return "; did you mean " + quotedList(closest) + "?"
+}
+
+// prefixMatches returns, sorted, the names that begin with prefix.
+func prefixMatches(prefix string, names []string) []string {
+	var matches []string
+	for _, name := range names {
+		if strings.HasPrefix(name, prefix) {
+			matches = append(matches, name)
+		}
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+// quotedList returns the names quoted and sorted, as in: "a", "b" or "c".
+func quotedList(names []string) string {
+	quoted := make([]string, len(names))
+	for k, name := range names {
+		quoted[k] = strconv.Quote(name)
+	}
+	sort.Strings(quoted)
+	if len(quoted) == 1 {
+		return quoted[0]
+	}
+	return strings.Join(quoted[:len(quoted)-1], ", ") + " or " + quoted[len(quoted)-1]
+}
+
+// editDistance returns the Levenshtein distance between a and b, counted in
+// runes.
+func editDistance(a, b string) int {
+	ra := []rune(a)
+	rb := []rune(b)
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = previous[j-1] + cost
+			if previous[j]+1 < current[j] {
+				current[j] = previous[j] + 1
+			}
+			if current[j-1]+1 < current[j] {
+				current[j] = current[j-1] + 1
+			}
+		}
+		previous, current = current, previous
+	}
+	return previous[len(rb)]
+}
+
+// requirementError indicates a value failed one of its option's required
+// tag checks, such as the file not existing for required:"file".
+type requirementError struct {
+	error
+}
+
+// FDWriter is the type of stdout given to RunAdvanced. The Fd is used to
+// determine whether the output is a terminal, for things like color and the
+// "terminal" default. If the writer also has a "Width() int" method, that
+// will be used as the width to wrap help text to; otherwise the terminal's
+// width is used if the Fd is a terminal, or 80 if not.
 type FDWriter interface {
 	io.Writer
 	Fd() uintptr
 }
 
-func setDuration(reflectValue reflect.Value, value time.Duration) {
-	if reflectValue.Type().Kind() == reflect.Ptr {
-		reflectValue.Set(reflect.ValueOf(&value))
-	} else {
-		reflectValue.Set(reflect.ValueOf(value))
+// writerWidth returns the width help text should be wrapped to for the
+// writer, as described by FDWriter. The terminal's width is that of the
+// writer's own Fd, not the process's controlling terminal, as the writer may
+// be another terminal altogether.
+func writerWidth(writer FDWriter) int {
+	if widther, ok := writer.(interface{ Width() int }); ok {
+		if width := widther.Width(); width > 0 {
+			return width
+		}
+	}
+	if isatty.IsTerminal(writer.Fd()) {
+		if width, _, err := terminal.GetSize(int(writer.Fd())); err == nil && width > 0 {
+			return width
+		}
 	}
+	return 80
 }
 
-func setBool(reflectValue reflect.Value, value bool) {
-	if reflectValue.Type().Kind() == reflect.Ptr {
-		reflectValue.Set(reflect.ValueOf(&value))
-	} else {
-		reflectValue.SetBool(value)
+// fieldOptionType returns the type of option the struct field is, as a
+// string like "bool", "int", "duration", etc. Slices are repeatable options,
+// each use appending another value, and are given a "[]" prefix, such as
+// "[]string".
+//
+// A field whose own type implements Value or encoding.TextUnmarshaler is a
+// single option even if it is a slice, such as net.IP.
+func fieldOptionType(reflectField reflect.StructField) string {
+	var optionType string
+	fieldType := reflectField.Type
+	switch {
+	case reflect.PtrTo(fieldType).Implements(valueType):
+		return "value"
+	case reflect.PtrTo(fieldType).Implements(textUnmarshalerType):
+		return "text"
+	}
+	switch fieldType.Kind() {
+	case reflect.Ptr:
+		fieldType = fieldType.Elem()
+	case reflect.Slice:
+		fieldType = fieldType.Elem()
+		optionType = "[]"
+	}
+	switch {
+	case reflect.PtrTo(fieldType).Implements(valueType):
+		optionType += "value"
+	case reflect.PtrTo(fieldType).Implements(textUnmarshalerType):
+		optionType += "text"
+	case fieldType == reflect.TypeOf(time.Duration(0)):
+		optionType += "duration"
+	case fieldType.Kind() == reflect.Bool && optionType == "":
+		optionType += "bool"
+	case fieldType.Kind() >= reflect.Int && fieldType.Kind() <= reflect.Uint64:
+		optionType += fieldType.Kind().String()
+	case fieldType.Kind() == reflect.Float32 || fieldType.Kind() == reflect.Float64:
+		optionType += fieldType.Kind().String()
+	case fieldType.Kind() == reflect.String:
+		optionType += "string"
+	default:
+		panic(fmt.Sprintln("cannot handle", reflectField.Type, reflectField.Name, reflectField.Type.Kind()))
 	}
+	return optionType
 }
 
-func setInt(reflectValue reflect.Value, value int64) {
-	if reflectValue.Type().Kind() == reflect.Ptr {
-		if reflectValue.Type().Elem().Kind() == reflect.Int {
-			ivalue := int(value)
-			reflectValue.Set(reflect.ValueOf(&ivalue))
-		} else {
-			reflectValue.Set(reflect.ValueOf(&value))
+// longName returns the option's first long name, such as "--count" for
+// option:"c,count", or its first name if it has no long names. Positional
+// arguments just have their own names.
+func longName(optionName string, tag reflect.StructTag) string {
+	if !strings.HasPrefix(optionName, "-") {
+		return optionName
+	}
+	names := strings.Split(tag.Get("option"), ",")
+	name := names[0]
+	for _, n := range names {
+		if len(n) > 1 {
+			name = n
+			break
 		}
-	} else {
-		reflectValue.SetInt(value)
 	}
+	if len(name) == 1 {
+		return "-" + name
+	}
+	return "--" + name
 }
 
-func setString(reflectValue reflect.Value, value string) {
-	if reflectValue.Type().Kind() == reflect.Ptr {
-		reflectValue.Set(reflect.ValueOf(&value))
-	} else {
-		reflectValue.SetString(value)
+// optionElemType returns the type of each value of an option of the field
+// type, unwrapping pointers and, for repeatable options, slices.
+func optionElemType(fieldType reflect.Type, optionType string) reflect.Type {
+	if fieldType.Kind() == reflect.Ptr || (fieldType.Kind() == reflect.Slice && strings.HasPrefix(optionType, "[]")) {
+		return fieldType.Elem()
+	}
+	return fieldType
+}
+
+// describeOption returns how to refer to the option in messages, such as
+// `option "--count"` or, for a positional argument, `argument "SOURCE"`.
+func describeOption(optionName string) string {
+	if strings.HasPrefix(optionName, "-") {
+		return fmt.Sprintf("option %q", optionName)
+	}
+	return fmt.Sprintf("argument %q", optionName)
+}
+
+// setValue sets the option's reflectValue to the parsed value, allocating a
+// new value if the option is a pointer, or appending if the option is a slice
+// of the parsed value's type. The parsed value is converted as needed, such
+// as from int64 to int.
+func setValue(reflectValue reflect.Value, parsed reflect.Value) {
+	if parsed.Type() == reflectValue.Type() {
+		reflectValue.Set(parsed)
+		return
+	}
+	switch reflectValue.Kind() {
+	case reflect.Ptr:
+		pointer := reflect.New(reflectValue.Type().Elem())
+		pointer.Elem().Set(parsed.Convert(pointer.Elem().Type()))
+		reflectValue.Set(pointer)
+	case reflect.Slice:
+		reflectValue.Set(reflect.Append(reflectValue, parsed.Convert(reflectValue.Type().Elem())))
+	default:
+		reflectValue.Set(parsed.Convert(reflectValue.Type()))
+	}
+}
+
+// splitDefaults splits a default tag on its commas, except for those escaped
+// with a backslash. For example, `default:"env:INCLUDE,a\\,b"` has the two
+// defaults of "env:INCLUDE" and "a,b".
+func splitDefaults(tag string) []string {
+	var dflts []string
+	var dflt strings.Builder
+	for i := 0; i < len(tag); i++ {
+		switch {
+		case tag[i] == '\\' && i+1 < len(tag) && tag[i+1] == ',':
+			i++
+			dflt.WriteByte(',')
+		case tag[i] == ',':
+			dflts = append(dflts, dflt.String())
+			dflt.Reset()
+		default:
+			dflt.WriteByte(tag[i])
+		}
 	}
+	return append(dflts, dflt.String())
 }
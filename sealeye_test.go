@@ -1,8 +1,20 @@
 package sealeye_test
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gholt/sealeye"
 )
@@ -29,3 +41,1639 @@ func TestIntPtrOptionBug(t *testing.T) {
 		t.Fatal(called)
 	}
 }
+
+type testOptionEqualsValueCLI struct {
+	Count int           `option:"c,count" help:"An int option."`
+	Delay time.Duration `option:"delay" help:"A duration option."`
+	Debug bool          `option:"debug" help:"A bool option." default:"true"`
+	Name  string        `option:"name" help:"A string option."`
+	Func  func(*testOptionEqualsValueCLI) int
+	Args  []string
+}
+
+func TestOptionEqualsValue(t *testing.T) {
+	testOptionEqualsValue := &testOptionEqualsValueCLI{Func: func(cli *testOptionEqualsValueCLI) int {
+		if cli.Count != 3 || cli.Delay != 5*time.Second || cli.Debug || cli.Name != "a=b" {
+			t.Fatal(cli.Count, cli.Delay, cli.Debug, cli.Name)
+		}
+		if len(cli.Args) != 1 || cli.Args[0] != "--count=4" {
+			t.Fatal(cli.Args)
+		}
+		return 0
+	}}
+	if exitCode := sealeye.RunAdvanced(os.Stdout, os.Stderr, t.Name(), testOptionEqualsValue, []string{"--count=3", "-delay=5s", "--debug=false", "--name=a=b", "--", "--count=4"}); exitCode != 0 {
+		t.Fatal(exitCode)
+	}
+	for _, args := range [][]string{{"--debug=maybe"}, {"--no-debug=true"}, {"--count="}, {"--nope=1"}} {
+		var stderr bytes.Buffer
+		if exitCode := sealeye.RunAdvanced(os.Stdout, &stderr, t.Name(), testOptionEqualsValue, args); exitCode != sealeye.ExitUsage {
+			t.Fatal(args, exitCode)
+		}
+		if stderr.Len() == 0 {
+			t.Fatal(args)
+		}
+	}
+}
+
+type testShortOptionClusterCLI struct {
+	All     bool   `option:"a" help:"A bool option."`
+	Bold    bool   `option:"b" help:"A bool option."`
+	Count   int    `option:"c" help:"An int option."`
+	Prefix  string `option:"p" help:"A string option."`
+	Version bool   `option:"version" help:"A long bool option."`
+	Func    func(*testShortOptionClusterCLI) int
+	Args    []string
+}
+
+func TestShortOptionCluster(t *testing.T) {
+	for _, test := range []struct {
+		args    []string
+		all     bool
+		bold    bool
+		count   int
+		prefix  string
+		version bool
+	}{
+		{[]string{"-ab"}, true, true, 0, "", false},
+		{[]string{"-abc", "3"}, true, true, 3, "", false},
+		{[]string{"-bc3"}, false, true, 3, "", false},
+		{[]string{"-c3"}, false, false, 3, "", false},
+		{[]string{"-c=3"}, false, false, 3, "", false},
+		{[]string{"-pfoo=bar"}, false, false, 0, "foo=bar", false},
+		{[]string{"-ap", "foo"}, true, false, 0, "foo", false},
+		{[]string{"-version"}, false, false, 0, "", true},
+	} {
+		testShortOptionCluster := &testShortOptionClusterCLI{Func: func(cli *testShortOptionClusterCLI) int {
+			if cli.All != test.all || cli.Bold != test.bold || cli.Count != test.count || cli.Prefix != test.prefix || cli.Version != test.version {
+				t.Fatal(test.args, cli.All, cli.Bold, cli.Count, cli.Prefix, cli.Version)
+			}
+			return 0
+		}}
+		if exitCode := sealeye.RunAdvanced(os.Stdout, os.Stderr, t.Name(), testShortOptionCluster, test.args); exitCode != 0 {
+			t.Fatal(test.args, exitCode)
+		}
+	}
+}
+
+type testSliceOptionCLI struct {
+	Include []string        `option:"include" help:"A repeatable string option." default:"a\\,b"`
+	Count   []int           `option:"c,count" help:"A repeatable int option." sep:","`
+	Delay   []time.Duration `option:"delay" help:"A repeatable duration option." default:"env:TEST_SLICE_OPTION_DELAY"`
+	Func    func(*testSliceOptionCLI) int
+	Args    []string
+}
+
+func TestSliceOption(t *testing.T) {
+	os.Setenv("TEST_SLICE_OPTION_DELAY", "1s,2m")
+	defer os.Unsetenv("TEST_SLICE_OPTION_DELAY")
+	for _, test := range []struct {
+		args    []string
+		include []string
+		count   []int
+		delay   []time.Duration
+	}{
+		{nil, []string{"a", "b"}, nil, []time.Duration{time.Second, 2 * time.Minute}},
+		{[]string{"--include", "x,y", "--include=z"}, []string{"x,y", "z"}, nil, []time.Duration{time.Second, 2 * time.Minute}},
+		{[]string{"-c", "1,2", "-c3", "--delay", "3h"}, []string{"a", "b"}, []int{1, 2, 3}, []time.Duration{3 * time.Hour}},
+	} {
+		testSliceOption := &testSliceOptionCLI{Func: func(cli *testSliceOptionCLI) int {
+			if !reflect.DeepEqual(cli.Include, test.include) || !reflect.DeepEqual(cli.Count, test.count) || !reflect.DeepEqual(cli.Delay, test.delay) {
+				t.Fatal(test.args, cli.Include, cli.Count, cli.Delay)
+			}
+			return 0
+		}}
+		if exitCode := sealeye.RunAdvanced(os.Stdout, os.Stderr, t.Name(), testSliceOption, test.args); exitCode != 0 {
+			t.Fatal(test.args, exitCode)
+		}
+	}
+}
+
+type testNumericOptionCLI struct {
+	Int8    int8     `option:"int8" help:"An int8 option."`
+	Int16   int16    `option:"int16" help:"An int16 option." default:"08"`
+	Int32   *int32   `option:"int32" help:"A pointer to an int32 option."`
+	Uint64  uint64   `option:"uint64" help:"A uint64 option." default:"0x_FFFF_FFFF_FFFF_FFFF"`
+	Uint16s []uint16 `option:"uint16" help:"A repeatable uint16 option."`
+	Float32 float32  `option:"float32" help:"A float32 option."`
+	Float64 *float64 `option:"float64" help:"A pointer to a float64 option."`
+	Func    func(*testNumericOptionCLI) int
+	Args    []string
+}
+
+func TestNumericOption(t *testing.T) {
+	testNumericOption := &testNumericOptionCLI{Func: func(cli *testNumericOptionCLI) int {
+		if cli.Int8 != -128 || cli.Int16 != 8 || cli.Int32 == nil || *cli.Int32 != 0x7f || cli.Uint64 != 1<<64-1 || !reflect.DeepEqual(cli.Uint16s, []uint16{5, 1_000, 10}) || cli.Float32 != 1.5 || cli.Float64 == nil || *cli.Float64 != 2e10 {
+			t.Fatal(cli.Int8, cli.Int16, cli.Int32, cli.Uint64, cli.Uint16s, cli.Float32, cli.Float64)
+		}
+		return 0
+	}}
+	if exitCode := sealeye.RunAdvanced(os.Stdout, os.Stderr, t.Name(), testNumericOption, []string{"--int8", "-128", "--int32=0b1111111", "--uint16", "0o5", "--uint16", "1_000", "--uint16", "010", "--float32", "1.5", "--float64", "2e10"}); exitCode != 0 {
+		t.Fatal(exitCode)
+	}
+	for _, args := range [][]string{{"--int8", "128"}, {"--uint16", "-1"}, {"--uint64", "0x1_0000_0000_0000_0000"}, {"--float32", "1e39"}, {"--float64", "x"}} {
+		var stderr bytes.Buffer
+		if exitCode := sealeye.RunAdvanced(os.Stdout, &stderr, t.Name(), testNumericOption, args); exitCode != sealeye.ExitUsage {
+			t.Fatal(args, exitCode)
+		}
+		if stderr.Len() == 0 {
+			t.Fatal(args)
+		}
+	}
+}
+
+type testTextOptionLevel int
+
+func (level *testTextOptionLevel) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "low":
+		*level = 1
+	case "high":
+		*level = 2
+	default:
+		return fmt.Errorf("unknown level %q", text)
+	}
+	return nil
+}
+
+type testValueOptionRegion struct {
+	name string
+}
+
+func (region *testValueOptionRegion) Set(value string) error {
+	if value == "" {
+		return fmt.Errorf("empty region")
+	}
+	region.name = value
+	return nil
+}
+
+func (region *testValueOptionRegion) String() string {
+	return region.name
+}
+
+func (region *testValueOptionRegion) Type() string {
+	return "region"
+}
+
+type testCustomOptionCLI struct {
+	Level   testTextOptionLevel     `option:"level" help:"A TextUnmarshaler option." default:"env:TEST_CUSTOM_OPTION_LEVEL,low"`
+	Since   *time.Time              `option:"since" help:"A pointer to a TextUnmarshaler option."`
+	Region  testValueOptionRegion   `option:"region" help:"A Value option." default:"us-east"`
+	Regions []testValueOptionRegion `option:"also" help:"A repeatable Value option."`
+	IP      net.IP                  `option:"ip" help:"A slice type that is a TextUnmarshaler."`
+	IPs     []net.IP                `option:"ips" help:"A repeatable slice type that is a TextUnmarshaler."`
+	Func    func(*testCustomOptionCLI) int
+	Args    []string
+}
+
+func TestCustomOption(t *testing.T) {
+	os.Setenv("TEST_CUSTOM_OPTION_LEVEL", "high")
+	defer os.Unsetenv("TEST_CUSTOM_OPTION_LEVEL")
+	testCustomOption := &testCustomOptionCLI{Func: func(cli *testCustomOptionCLI) int {
+		if cli.Level != 2 || cli.Since != nil || cli.Region.name != "us-west" || len(cli.Regions) != 2 || cli.Regions[1].name != "eu" || !cli.IP.Equal(net.IPv4(10, 0, 0, 1)) || len(cli.IPs) != 2 || !cli.IPs[1].Equal(net.IPv4(10, 0, 0, 3)) {
+			t.Fatal(cli.Level, cli.Since, cli.Region, cli.Regions, cli.IP, cli.IPs)
+		}
+		return 0
+	}}
+	if exitCode := sealeye.RunAdvanced(os.Stdout, os.Stderr, t.Name(), testCustomOption, []string{"--region", "us-west", "--also", "ap", "--also=eu", "--ip", "10.0.0.1", "--ips", "10.0.0.2", "--ips", "10.0.0.3"}); exitCode != 0 {
+		t.Fatal(exitCode)
+	}
+	for _, args := range [][]string{{"--level", "medium"}, {"--region="}, {"--since", "yesterday"}, {"--ip", "10.0.0"}} {
+		var stderr bytes.Buffer
+		if exitCode := sealeye.RunAdvanced(os.Stdout, &stderr, t.Name(), testCustomOption, args); exitCode != sealeye.ExitUsage {
+			t.Fatal(args, exitCode)
+		}
+		if stderr.Len() == 0 {
+			t.Fatal(args)
+		}
+	}
+}
+
+type testChoicesOptionCLI struct {
+	Format  string   `option:"format" help:"A string option with choices." choices:"json,yaml,table" default:"env:TEST_CHOICES_OPTION_FORMAT,table"`
+	Level   int      `option:"level" help:"An int option with choices." choices:"1,2,3"`
+	Formats []string `option:"also" help:"A repeatable option with choices." choices:"json,yaml,table"`
+	Func    func(*testChoicesOptionCLI) int
+	Args    []string
+}
+
+func TestChoicesOption(t *testing.T) {
+	testChoicesOption := &testChoicesOptionCLI{Func: func(cli *testChoicesOptionCLI) int {
+		if cli.Format != "table" || cli.Level != 2 || !reflect.DeepEqual(cli.Formats, []string{"json", "yaml"}) {
+			t.Fatal(cli.Format, cli.Level, cli.Formats)
+		}
+		return 0
+	}}
+	if exitCode := sealeye.RunAdvanced(os.Stdout, os.Stderr, t.Name(), testChoicesOption, []string{"--level", "0x2", "--also", "json", "--also", "yaml"}); exitCode != 0 {
+		t.Fatal(exitCode)
+	}
+	for _, args := range [][]string{{"--format", "xml"}, {"--level", "4"}, {"--also", "json", "--also", "csv"}} {
+		var stderr bytes.Buffer
+		if exitCode := sealeye.RunAdvanced(os.Stdout, &stderr, t.Name(), testChoicesOption, args); exitCode != sealeye.ExitUsage {
+			t.Fatal(args, exitCode)
+		}
+		if !strings.Contains(stderr.String(), "must be one of") {
+			t.Fatal(args, stderr.String())
+		}
+	}
+	os.Setenv("TEST_CHOICES_OPTION_FORMAT", "csv")
+	defer os.Unsetenv("TEST_CHOICES_OPTION_FORMAT")
+	var stderr bytes.Buffer
+	if exitCode := sealeye.RunAdvanced(os.Stdout, &stderr, t.Name(), testChoicesOption, nil); exitCode != sealeye.ExitFailure {
+		t.Fatal(exitCode)
+	}
+	if !strings.Contains(stderr.String(), "$TEST_CHOICES_OPTION_FORMAT") {
+		t.Fatal(stderr.String())
+	}
+}
+
+type testConstraintOptionCLI struct {
+	Port    uint16        `option:"port" help:"A ranged option." min:"1" max:"65535" default:"env:TEST_CONSTRAINT_OPTION_PORT,8080"`
+	Ratio   float64       `option:"ratio" help:"A ranged float option." min:"0" max:"1"`
+	Timeout time.Duration `option:"timeout" help:"A ranged duration option." min:"1s" max:"1h"`
+	Name    string        `option:"name" help:"A patterned option." pattern:"^[a-z0-9-]+$" minlen:"2" maxlen:"8" default:"abc"`
+	Func    func(*testConstraintOptionCLI) int
+	Args    []string
+}
+
+func TestConstraintOption(t *testing.T) {
+	testConstraintOption := &testConstraintOptionCLI{Func: func(cli *testConstraintOptionCLI) int {
+		if cli.Port != 8080 || cli.Ratio != 0.5 || cli.Timeout != time.Minute || cli.Name != "a-1" {
+			t.Fatal(cli.Port, cli.Ratio, cli.Timeout, cli.Name)
+		}
+		return 0
+	}}
+	if exitCode := sealeye.RunAdvanced(os.Stdout, os.Stderr, t.Name(), testConstraintOption, []string{"--ratio", "0.5", "--timeout", "1m", "--name", "a-1"}); exitCode != 0 {
+		t.Fatal(exitCode)
+	}
+	for _, args := range [][]string{{"--port", "0"}, {"--ratio", "1.1"}, {"--timeout", "2h"}, {"--name", "A"}, {"--name", "a"}, {"--name", "abcdefghi"}} {
+		var stderr bytes.Buffer
+		if exitCode := sealeye.RunAdvanced(os.Stdout, &stderr, t.Name(), testConstraintOption, args); exitCode != sealeye.ExitUsage {
+			t.Fatal(args, exitCode)
+		}
+		if !strings.Contains(stderr.String(), "must") {
+			t.Fatal(args, stderr.String())
+		}
+	}
+	os.Setenv("TEST_CONSTRAINT_OPTION_PORT", "0")
+	defer os.Unsetenv("TEST_CONSTRAINT_OPTION_PORT")
+	var stderr bytes.Buffer
+	if exitCode := sealeye.RunAdvanced(os.Stdout, &stderr, t.Name(), testConstraintOption, nil); exitCode != sealeye.ExitFailure {
+		t.Fatal(exitCode)
+	}
+	if !strings.Contains(stderr.String(), "must be at least 1") {
+		t.Fatal(stderr.String())
+	}
+}
+
+type testRequiredSetOptionCLI struct {
+	HelpOption bool   `option:"help" help:"Outputs this help text."`
+	Name       string `option:"name" help:"A required option." required:"set"`
+	Token      string `option:"token" help:"A required option with a default." required:"set" default:"env:TEST_REQUIRED_SET_OPTION_TOKEN"`
+	Func       func(*testRequiredSetOptionCLI) int
+	Args       []string
+}
+
+func TestRequiredSetOption(t *testing.T) {
+	called := false
+	testRequiredSetOption := &testRequiredSetOptionCLI{Func: func(cli *testRequiredSetOptionCLI) int {
+		called = true
+		return 0
+	}}
+	var stderr bytes.Buffer
+	if exitCode := sealeye.RunAdvanced(os.Stdout, &stderr, t.Name(), testRequiredSetOption, nil); exitCode != sealeye.ExitUsage {
+		t.Fatal(exitCode)
+	}
+	if !strings.Contains(stderr.String(), `"--name"`) || !strings.Contains(stderr.String(), `"--token"`) || called {
+		t.Fatal(stderr.String(), called)
+	}
+	os.Setenv("TEST_REQUIRED_SET_OPTION_TOKEN", "")
+	defer os.Unsetenv("TEST_REQUIRED_SET_OPTION_TOKEN")
+	if exitCode := sealeye.RunAdvanced(os.Stdout, os.Stderr, t.Name(), testRequiredSetOption, []string{"--name", "x"}); exitCode != 0 || !called {
+		t.Fatal(exitCode, called)
+	}
+}
+
+type testRequiredSetSubcommandCLI struct {
+	Token       string `option:"token" help:"A required persistent option." required:"set" persistent:"true"`
+	Subcommands map[string]interface{}
+}
+
+type testRequiredSetSubcommandSubcommandCLI struct {
+	Count int `option:"count" help:"A required option." required:"set"`
+	Func  func(*testRequiredSetSubcommandSubcommandCLI) int
+}
+
+func TestRequiredSetSubcommand(t *testing.T) {
+	called := false
+	testRequiredSetSubcommand := &testRequiredSetSubcommandCLI{Subcommands: map[string]interface{}{"sub": &testRequiredSetSubcommandSubcommandCLI{Func: func(cli *testRequiredSetSubcommandSubcommandCLI) int {
+		called = true
+		return 0
+	}}}}
+	var stderr bytes.Buffer
+	if exitCode := sealeye.RunAdvanced(os.Stdout, &stderr, t.Name(), testRequiredSetSubcommand, []string{"sub"}); exitCode != sealeye.ExitUsage || called {
+		t.Fatal(exitCode, called)
+	}
+	if message := strings.SplitN(stderr.String(), "\n", 2)[0]; message != `missing required options "--token", "--count"` {
+		t.Fatal(message)
+	}
+	for _, args := range [][]string{{"--token", "t", "sub", "--count", "1"}, {"sub", "--count", "1", "--token", "t"}} {
+		called = false
+		if exitCode := sealeye.RunAdvanced(os.Stdout, os.Stderr, t.Name(), &testRequiredSetSubcommandCLI{Subcommands: testRequiredSetSubcommand.Subcommands}, args); exitCode != 0 || !called {
+			t.Fatal(args, exitCode, called)
+		}
+	}
+}
+
+type testRelatedPersistentCLI struct {
+	JSON        bool `option:"json" help:"A conflicting option." conflicts:"table" persistent:"true"`
+	Table       bool `option:"table" help:"A conflicting option." conflicts:"json" persistent:"true"`
+	Subcommands map[string]interface{}
+}
+
+type testRelatedPersistentSubcommandCLI struct {
+	Verbose bool `option:"verbose" help:"An option that requires a persistent option." requires:"json"`
+	Quiet   bool `option:"quiet" help:"An option that conflicts with a persistent option." conflicts:"table"`
+	Func    func(*testRelatedPersistentSubcommandCLI) int
+}
+
+func TestRelatedPersistent(t *testing.T) {
+	subcommands := map[string]interface{}{"sub": &testRelatedPersistentSubcommandCLI{Func: func(cli *testRelatedPersistentSubcommandCLI) int {
+		return 0
+	}}}
+	for _, test := range []struct {
+		args    []string
+		message string
+	}{
+		{[]string{"--json", "--table", "sub"}, `option "--json" cannot be used with "--table"`},
+		{[]string{"sub", "--json", "--table"}, `option "--json" cannot be used with "--table"`},
+		{[]string{"--json", "sub", "--table"}, `option "--json" cannot be used with "--table"`},
+		{[]string{"sub", "--verbose"}, `option "--verbose" requires "--json"`},
+		{[]string{"sub", "--quiet", "--table"}, `option "--quiet" cannot be used with "--table"`},
+		{[]string{"--table", "sub", "--quiet"}, `option "--quiet" cannot be used with "--table"`},
+	} {
+		var stderr bytes.Buffer
+		if exitCode := sealeye.RunAdvanced(os.Stdout, &stderr, t.Name(), &testRelatedPersistentCLI{Subcommands: subcommands}, test.args); exitCode != sealeye.ExitUsage {
+			t.Fatal(test.args, exitCode)
+		}
+		if message := strings.SplitN(stderr.String(), "\n", 2)[0]; message != test.message {
+			t.Fatal(test.args, message)
+		}
+	}
+	for _, args := range [][]string{{"sub", "--json"}, {"--json", "sub", "--verbose"}, {"sub", "--verbose", "--json"}, {"sub", "--quiet"}} {
+		if exitCode := sealeye.RunAdvanced(os.Stdout, os.Stderr, t.Name(), &testRelatedPersistentCLI{Subcommands: subcommands}, args); exitCode != 0 {
+			t.Fatal(args, exitCode)
+		}
+	}
+}
+
+type testRelatedOptionCLI struct {
+	JSON  bool   `option:"json" help:"A conflicting option." conflicts:"table"`
+	Table bool   `option:"t,table" help:"A conflicting option." conflicts:"json"`
+	Cert  string `option:"cert" help:"An option that requires another." requires:"key"`
+	Key   string `option:"key" help:"An option that is required by another." requires:"cert" default:"env:TEST_RELATED_OPTION_KEY"`
+	Func  func(*testRelatedOptionCLI) int
+	Args  []string
+}
+
+func TestRelatedOption(t *testing.T) {
+	testRelatedOption := &testRelatedOptionCLI{Func: func(cli *testRelatedOptionCLI) int {
+		return 0
+	}}
+	for _, args := range [][]string{nil, {"--json"}, {"-t", "--json=false"}, {"--cert", "a", "--key", "b"}} {
+		if exitCode := sealeye.RunAdvanced(os.Stdout, os.Stderr, t.Name(), testRelatedOption, args); exitCode != 0 {
+			t.Fatal(args, exitCode)
+		}
+	}
+	for _, test := range []struct {
+		args    []string
+		message string
+	}{
+		{[]string{"--json", "-t"}, `option "--json" cannot be used with "--table"`},
+		{[]string{"--cert", "a"}, `option "--cert" requires "--key"`},
+		{[]string{"--key", "b"}, `option "--key" requires "--cert"`},
+	} {
+		var stderr bytes.Buffer
+		if exitCode := sealeye.RunAdvanced(os.Stdout, &stderr, t.Name(), testRelatedOption, test.args); exitCode != sealeye.ExitUsage {
+			t.Fatal(test.args, exitCode)
+		}
+		if strings.SplitN(stderr.String(), "\n", 2)[0] != test.message {
+			t.Fatal(test.args, stderr.String())
+		}
+	}
+	os.Setenv("TEST_RELATED_OPTION_KEY", "b")
+	defer os.Unsetenv("TEST_RELATED_OPTION_KEY")
+	if exitCode := sealeye.RunAdvanced(os.Stdout, os.Stderr, t.Name(), testRelatedOption, []string{"--cert", "a"}); exitCode != 0 {
+		t.Fatal(exitCode)
+	}
+}
+
+type testPositionalArgCLI struct {
+	Verbose bool     `option:"v" help:"A bool option."`
+	Source  string   `arg:"0" name:"SOURCE" help:"A required positional argument." required:"set"`
+	Count   int      `arg:"1" help:"An optional positional argument." default:"7"`
+	Rest    []string `arg:"rest" name:"FILE" help:"The remaining arguments."`
+	Func    func(*testPositionalArgCLI) int
+}
+
+type testPositionalArgNoRestCLI struct {
+	Source string `arg:"0" help:"A positional argument."`
+	Func   func(*testPositionalArgNoRestCLI) int
+}
+
+type testPositionalArgsFieldCLI struct {
+	Args []int `arg:"rest" help:"Positional arguments in a field named Args."`
+	Func func(*testPositionalArgsFieldCLI) int
+}
+
+func TestPositionalArg(t *testing.T) {
+	for _, test := range []struct {
+		args    []string
+		verbose bool
+		source  string
+		count   int
+		rest    []string
+	}{
+		{[]string{"a"}, false, "a", 7, nil},
+		{[]string{"a", "-v", "0x10"}, true, "a", 16, nil},
+		{[]string{"a", "1", "b", "--", "-c"}, false, "a", 1, []string{"b", "-c"}},
+	} {
+		testPositionalArg := &testPositionalArgCLI{Func: func(cli *testPositionalArgCLI) int {
+			if cli.Verbose != test.verbose || cli.Source != test.source || cli.Count != test.count || !reflect.DeepEqual(cli.Rest, test.rest) {
+				t.Fatal(test.args, cli.Verbose, cli.Source, cli.Count, cli.Rest)
+			}
+			return 0
+		}}
+		if exitCode := sealeye.RunAdvanced(os.Stdout, os.Stderr, t.Name(), testPositionalArg, test.args); exitCode != 0 {
+			t.Fatal(test.args, exitCode)
+		}
+	}
+	// A field named Args is an ordinary positional argument if it has an arg
+	// tag, rather than the raw remaining arguments.
+	testPositionalArgsField := &testPositionalArgsFieldCLI{Func: func(cli *testPositionalArgsFieldCLI) int {
+		if !reflect.DeepEqual(cli.Args, []int{1, 2}) {
+			t.Fatal(cli.Args)
+		}
+		return 0
+	}}
+	if exitCode := sealeye.RunAdvanced(os.Stdout, os.Stderr, t.Name(), testPositionalArgsField, []string{"1", "2"}); exitCode != 0 {
+		t.Fatal(exitCode)
+	}
+	for _, test := range []struct {
+		cli     interface{}
+		args    []string
+		message string
+	}{
+		{&testPositionalArgCLI{}, nil, `missing required argument "SOURCE"`},
+		{&testPositionalArgCLI{}, []string{"a", "b"}, `invalid integer "b" for argument "COUNT"`},
+		{&testPositionalArgNoRestCLI{}, []string{"a", "b"}, `unexpected argument "b"`},
+		{&testPositionalArgsFieldCLI{}, []string{"1", "x"}, `invalid integer "x" for argument "ARGS"`},
+	} {
+		var stderr bytes.Buffer
+		if exitCode := sealeye.RunAdvanced(os.Stdout, &stderr, t.Name(), test.cli, test.args); exitCode != sealeye.ExitUsage {
+			t.Fatal(test.args, exitCode)
+		}
+		if strings.SplitN(stderr.String(), "\n", 2)[0] != test.message {
+			t.Fatal(test.args, stderr.String())
+		}
+	}
+}
+
+type testUsageCLI struct {
+	Help       string
+	HelpOption bool     `option:"h,help" help:"Outputs this help text."`
+	Source     string   `arg:"0" name:"SOURCE" help:"A required positional argument." required:"set"`
+	Dest       []string `arg:"rest" name:"DEST" help:"The remaining arguments."`
+	Func       func(*testUsageCLI) int
+}
+
+func TestUsage(t *testing.T) {
+	for _, test := range []struct {
+		help     string
+		expected string
+	}{
+		{"\nSome help text.\n", "Usage: test [options] SOURCE [DEST...]"},
+		{"\nUsage: {{.Usage}}\n\nSome help text.\n", "Usage: test [options] SOURCE [DEST...]"},
+		{"\nUsage: {{.Command}} [flags] SOURCE\n", "Usage: test [flags] SOURCE"},
+	} {
+		stdout, err := ioutil.TempFile("", t.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(stdout.Name())
+		defer stdout.Close()
+		testUsage := &testUsageCLI{Help: test.help}
+		sealeye.RunAdvanced(stdout, os.Stderr, "test", testUsage, []string{"--help"})
+		output, err := ioutil.ReadFile(stdout.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Count(string(output), "Usage:") != 1 || !strings.Contains(string(output), test.expected) {
+			t.Fatalf("%q %q", test.help, output)
+		}
+	}
+}
+
+type testExitCodeCLI struct {
+	UsageExitCode int
+	HelpOption    bool `option:"h,help" help:"Outputs this help text."`
+	Func          func(*testExitCodeCLI) int
+}
+
+func TestExitCode(t *testing.T) {
+	stdout, err := ioutil.TempFile("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(stdout.Name())
+	defer stdout.Close()
+	testExitCode := &testExitCodeCLI{Func: func(cli *testExitCodeCLI) int {
+		return sealeye.ExitOK
+	}}
+	var stderr bytes.Buffer
+	if exitCode := sealeye.RunAdvanced(stdout, &stderr, "test", testExitCode, []string{"--help"}); exitCode != sealeye.ExitOK {
+		t.Fatal(exitCode)
+	}
+	if stderr.Len() != 0 {
+		t.Fatal(stderr.String())
+	}
+	if exitCode := sealeye.RunAdvanced(stdout, &stderr, "test", testExitCode, []string{"--nope"}); exitCode != sealeye.ExitUsage {
+		t.Fatal(exitCode)
+	}
+	if stderr.String() != "unknown option \"--nope\"\nUsage: test [options]\nTry \"test --help\" for more information.\n" {
+		t.Fatal(stderr.String())
+	}
+	testExitCode.UsageExitCode = 64
+	if exitCode := sealeye.RunAdvanced(stdout, &stderr, "test", testExitCode, []string{"--nope"}); exitCode != 64 {
+		t.Fatal(exitCode)
+	}
+}
+
+type testHelpWriter struct {
+	bytes.Buffer
+}
+
+func (writer *testHelpWriter) Fd() uintptr {
+	return ^uintptr(0)
+}
+
+func (writer *testHelpWriter) Width() int {
+	return 40
+}
+
+type testHelpOutputCLI struct {
+	Help          string
+	HelpOption    bool   `option:"?,h,help" help:"Outputs this help text."`
+	AllHelpOption bool   `option:"all-help" help:"Outputs help text for all subcommands."`
+	Prefix        string `option:"p,prefix" help:"A string option."`
+	Func          func(*testHelpOutputCLI) int
+	Subcommands   map[string]interface{}
+}
+
+type testHelpOutputSubcommandCLI struct {
+	QuickHelp     string
+	AllHelpOption bool `option:"all-help" help:"Outputs help text for all subcommands."`
+	Func          func(*testHelpOutputSubcommandCLI) int
+}
+
+func TestHelpOutput(t *testing.T) {
+	testHelpOutput := &testHelpOutputCLI{
+		Help: "\nSome help text.\n",
+		Subcommands: map[string]interface{}{
+			"sub": &testHelpOutputSubcommandCLI{QuickHelp: "A subcommand."},
+		},
+	}
+	for _, args := range [][]string{{"--help"}, {"--all-help"}} {
+		var stdout testHelpWriter
+		var stderr bytes.Buffer
+		if exitCode := sealeye.RunAdvanced(&stdout, &stderr, "test", testHelpOutput, args); exitCode != sealeye.ExitOK {
+			t.Fatal(args, exitCode)
+		}
+		output := stdout.String()
+		for _, expected := range []string{"Usage: test [options] [subcommand]", "Some help text.", "Options:", "--prefix", "Subcommands:", "A subcommand."} {
+			if !strings.Contains(output, expected) {
+				t.Fatalf("%v %q %q", args, expected, output)
+			}
+		}
+		if args[0] == "--all-help" && !strings.Contains(output, "---[ test sub ]"+strings.Repeat("-", 40-len("---[ test sub ]")-1)+"\n") {
+			t.Fatal(output)
+		}
+		if stderr.Len() != 0 {
+			t.Fatal(stderr.String())
+		}
+	}
+}
+
+type testDidYouMeanCLI struct {
+	Prefix            string `option:"prefix" help:"A string option."`
+	Debug             bool   `option:"debug" help:"A bool option."`
+	Secret            bool   `option:"secret" help:"A hidden option." hidden:"true"`
+	Func              func(*testDidYouMeanCLI) int
+	Subcommands       map[string]interface{}
+	HiddenSubcommands map[string]interface{}
+}
+
+type testDidYouMeanSubcommandCLI struct {
+	Func func(*testDidYouMeanSubcommandCLI) int
+}
+
+func TestDidYouMean(t *testing.T) {
+	testDidYouMean := &testDidYouMeanCLI{
+		Subcommands: map[string]interface{}{
+			"version": &testDidYouMeanSubcommandCLI{},
+			"status":  &testDidYouMeanSubcommandCLI{},
+			"state":   &testDidYouMeanSubcommandCLI{},
+		},
+		HiddenSubcommands: map[string]interface{}{
+			"versions": &testDidYouMeanSubcommandCLI{},
+		},
+	}
+	for _, test := range []struct {
+		args    []string
+		message string
+	}{
+		{[]string{"--prefx", "x"}, `unknown option "--prefx"; did you mean "--prefix"?`},
+		{[]string{"-prefx=x"}, `unknown option "--prefx"; did you mean "--prefix"?`},
+		{[]string{"--no-debg"}, `unknown option "--no-debg"; did you mean "--no-debug"?`},
+		{[]string{"--secrt"}, `unknown option "--secrt"`},
+		{[]string{"--zzz"}, `unknown option "--zzz"`},
+		{[]string{"vesion"}, `unknown subcommand "vesion"; did you mean "version"?`},
+		{[]string{"stats"}, `unknown subcommand "stats"; did you mean "state" or "status"?`},
+		{[]string{"zzz"}, `unknown subcommand "zzz"`},
+	} {
+		var stderr bytes.Buffer
+		if exitCode := sealeye.RunAdvanced(os.Stdout, &stderr, "test", testDidYouMean, test.args); exitCode != sealeye.ExitUsage {
+			t.Fatal(test.args, exitCode)
+		}
+		if message := strings.SplitN(stderr.String(), "\n", 2)[0]; message != test.message {
+			t.Fatalf("%v %q", test.args, message)
+		}
+	}
+}
+
+type testAbbreviationCLI struct {
+	AllowAbbreviations bool
+	Prefix             string `option:"prefix" help:"A string option."`
+	Prompt             string `option:"prompt" help:"A string option."`
+	Color              bool   `option:"color,colour" help:"A bool option." default:"true"`
+	Func               func(*testAbbreviationCLI) int
+	Subcommands        map[string]interface{}
+}
+
+type testAbbreviationSubcommandCLI struct {
+	Parent interface{}
+	Debug  bool `option:"debug" help:"A bool option."`
+	Func   func(*testAbbreviationSubcommandCLI) int
+}
+
+func TestAbbreviation(t *testing.T) {
+	var ran string
+	subcommand := func(name string) *testAbbreviationSubcommandCLI {
+		return &testAbbreviationSubcommandCLI{Func: func(cli *testAbbreviationSubcommandCLI) int {
+			if !cli.Debug {
+				t.Fatal(name, cli.Debug)
+			}
+			ran = name
+			return 0
+		}}
+	}
+	testAbbreviation := &testAbbreviationCLI{
+		AllowAbbreviations: true,
+		Func: func(cli *testAbbreviationCLI) int {
+			if cli.Prefix != "x" || cli.Color {
+				t.Fatal(cli.Prefix, cli.Color)
+			}
+			ran = "root"
+			return 0
+		},
+		Subcommands: map[string]interface{}{
+			"version": subcommand("version"),
+			"status":  subcommand("status"),
+			"state":   subcommand("state"),
+		},
+	}
+	for _, test := range []struct {
+		args []string
+		ran  string
+	}{
+		{[]string{"--pre", "x", "--no-col"}, "root"},
+		{[]string{"--pref=x", "-no-c"}, "root"},
+		{[]string{"ver", "--deb"}, "version"},
+		{[]string{"statu", "--d"}, "status"},
+	} {
+		ran = ""
+		if exitCode := sealeye.RunAdvanced(os.Stdout, os.Stderr, "test", testAbbreviation, test.args); exitCode != 0 || ran != test.ran {
+			t.Fatal(test.args, exitCode, ran)
+		}
+	}
+	for _, test := range []struct {
+		args    []string
+		message string
+	}{
+		{[]string{"--pr", "x"}, `option "--pr" is ambiguous; could be "--prefix" or "--prompt"`},
+		{[]string{"--p", "x"}, `option "--p" is ambiguous; could be "--prefix" or "--prompt"`},
+		{[]string{"sta"}, `subcommand "sta" is ambiguous; could be "state" or "status"`},
+	} {
+		var stderr bytes.Buffer
+		if exitCode := sealeye.RunAdvanced(os.Stdout, &stderr, "test", testAbbreviation, test.args); exitCode != sealeye.ExitUsage {
+			t.Fatal(test.args, exitCode)
+		}
+		if message := strings.SplitN(stderr.String(), "\n", 2)[0]; message != test.message {
+			t.Fatalf("%v %q", test.args, message)
+		}
+	}
+	testAbbreviation.AllowAbbreviations = false
+	if exitCode := sealeye.RunAdvanced(os.Stdout, ioutil.Discard, "test", testAbbreviation, []string{"--pre", "x"}); exitCode != sealeye.ExitUsage {
+		t.Fatal(exitCode)
+	}
+}
+
+type testAliasCLI struct {
+	AllHelpOption bool `option:"all-help" help:"Outputs help text for all subcommands."`
+	Func          func(*testAliasCLI) int
+	Subcommands   map[string]interface{}
+}
+
+type testAliasSubcommandCLI struct {
+	QuickHelp     string
+	AllHelpOption bool `option:"all-help" help:"Outputs help text for all subcommands."`
+	Aliases       []string
+	Func          func(*testAliasSubcommandCLI) int
+}
+
+func TestAlias(t *testing.T) {
+	var ran string
+	subcommand := func(name string, aliases ...string) *testAliasSubcommandCLI {
+		return &testAliasSubcommandCLI{QuickHelp: "The " + name + " subcommand.", Aliases: aliases, Func: func(cli *testAliasSubcommandCLI) int {
+			ran = name
+			return 0
+		}}
+	}
+	list := subcommand("list")
+	testAlias := &testAliasCLI{Subcommands: map[string]interface{}{
+		"remove": subcommand("remove", "rm", "delete"),
+		"list":   list,
+		"ls":     list,
+	}}
+	for _, test := range []struct {
+		args []string
+		ran  string
+	}{
+		{[]string{"remove"}, "remove"},
+		{[]string{"rm"}, "remove"},
+		{[]string{"delete"}, "remove"},
+		{[]string{"ls"}, "list"},
+	} {
+		ran = ""
+		if exitCode := sealeye.RunAdvanced(os.Stdout, os.Stderr, "test", testAlias, test.args); exitCode != 0 || ran != test.ran {
+			t.Fatal(test.args, exitCode, ran)
+		}
+	}
+	var stderr bytes.Buffer
+	if exitCode := sealeye.RunAdvanced(os.Stdout, &stderr, "test", testAlias, []string{"delet"}); exitCode != sealeye.ExitUsage {
+		t.Fatal(exitCode)
+	}
+	if message := strings.SplitN(stderr.String(), "\n", 2)[0]; message != `unknown subcommand "delet"; did you mean "delete"?` {
+		t.Fatal(message)
+	}
+	var stdout testHelpWriter
+	if exitCode := sealeye.RunAdvanced(&stdout, os.Stderr, "test", testAlias, []string{"--all-help"}); exitCode != 0 {
+		t.Fatal(exitCode)
+	}
+	output := stdout.String()
+	if !strings.Contains(output, "remove (rm, delete)") || strings.Contains(output, "---[ test rm ]") || strings.Count(output, "---[ test l") != 1 {
+		t.Fatal(output)
+	}
+}
+
+type testPersistentCLI struct {
+	Debug       bool     `option:"v,debug" help:"A persistent bool option." persistent:"true"`
+	Tags        []string `option:"tag" help:"A persistent repeatable option." default:"x" persistent:"true"`
+	Func        func(*testPersistentCLI) int
+	Subcommands map[string]interface{}
+}
+
+type testPersistentSubcommandCLI struct {
+	Parent      interface{}
+	HelpOption  bool `option:"h,help" help:"Outputs this help text."`
+	Debug       bool
+	Func        func(*testPersistentSubcommandCLI) int
+	Subcommands map[string]interface{}
+}
+
+type testPersistentSubsubcommandCLI struct {
+	Tags []string
+	Func func(*testPersistentSubsubcommandCLI) int
+}
+
+func TestPersistent(t *testing.T) {
+	var debug bool
+	var tags []string
+	sub := &testPersistentSubcommandCLI{Func: func(cli *testPersistentSubcommandCLI) int {
+		if cli.Parent.(*testPersistentCLI).Debug != cli.Debug {
+			t.Fatal(cli.Parent.(*testPersistentCLI).Debug, cli.Debug)
+		}
+		debug = cli.Debug
+		return 0
+	}}
+	sub.Subcommands = map[string]interface{}{
+		"subsub": &testPersistentSubsubcommandCLI{Func: func(cli *testPersistentSubsubcommandCLI) int {
+			tags = cli.Tags
+			return 0
+		}},
+	}
+	testPersistent := &testPersistentCLI{Subcommands: map[string]interface{}{"sub": sub}}
+	for _, test := range []struct {
+		args  []string
+		debug bool
+		tags  []string
+	}{
+		{[]string{"sub"}, false, nil},
+		{[]string{"--debug", "sub"}, true, nil},
+		{[]string{"sub", "--debug"}, true, nil},
+		{[]string{"sub", "-v"}, true, nil},
+		{[]string{"sub", "subsub"}, false, []string{"x"}},
+		{[]string{"--tag", "a", "sub", "subsub", "--tag=b"}, false, []string{"a", "b"}},
+		{[]string{"sub", "subsub", "--tag", "c"}, false, []string{"c"}},
+	} {
+		debug, tags = false, nil
+		if exitCode := sealeye.RunAdvanced(os.Stdout, os.Stderr, "test", testPersistent, test.args); exitCode != 0 {
+			t.Fatal(test.args, exitCode)
+		}
+		if debug != test.debug || !reflect.DeepEqual(tags, test.tags) {
+			t.Fatal(test.args, debug, tags)
+		}
+	}
+	var stdout testHelpWriter
+	if exitCode := sealeye.RunAdvanced(&stdout, os.Stderr, "test", testPersistent, []string{"sub", "--help"}); exitCode != 0 {
+		t.Fatal(exitCode)
+	}
+	if output := stdout.String(); !strings.Contains(output, "Usage: test sub [options] [subcommand]") || !strings.Contains(output, "Global options:") || !strings.Contains(output, "--debug") || !strings.Contains(output, "--tag s...") {
+		t.Fatal(output)
+	}
+}
+
+type testHookCLI struct {
+	PersistentBefore func(*testHookCLI) int
+	PersistentAfter  func(*testHookCLI)
+	Before           func(*testHookCLI) int
+	After            func(*testHookCLI)
+	Func             func(*testHookCLI) int
+	Subcommands      map[string]interface{}
+}
+
+type testHookSubcommandCLI struct {
+	PersistentBefore func(*testHookSubcommandCLI) int
+	PersistentAfter  func(*testHookSubcommandCLI) int
+	Before           func(*testHookSubcommandCLI) int
+	After            func(*testHookSubcommandCLI) int
+	Func             func(*testHookSubcommandCLI) int
+}
+
+func TestHook(t *testing.T) {
+	var calls []string
+	abort := ""
+	call := func(name string) int {
+		calls = append(calls, name)
+		if name == abort {
+			return 3
+		}
+		if name == "sub.Func" && abort == "panic" {
+			panic(name)
+		}
+		return 0
+	}
+	testHook := &testHookCLI{
+		PersistentBefore: func(*testHookCLI) int { return call("root.PersistentBefore") },
+		PersistentAfter:  func(*testHookCLI) { call("root.PersistentAfter") },
+		Before:           func(*testHookCLI) int { return call("root.Before") },
+		After:            func(*testHookCLI) { call("root.After") },
+		Func:             func(*testHookCLI) int { return call("root.Func") },
+		Subcommands: map[string]interface{}{
+			"sub": &testHookSubcommandCLI{
+				PersistentBefore: func(*testHookSubcommandCLI) int { return call("sub.PersistentBefore") },
+				PersistentAfter:  func(*testHookSubcommandCLI) int { return call("sub.PersistentAfter") },
+				Before:           func(*testHookSubcommandCLI) int { return call("sub.Before") },
+				After:            func(*testHookSubcommandCLI) int { return call("sub.After") },
+				Func:             func(*testHookSubcommandCLI) int { return call("sub.Func") },
+			},
+		},
+	}
+	for _, test := range []struct {
+		args     []string
+		abort    string
+		exitCode int
+		calls    string
+	}{
+		{nil, "", 0, "root.PersistentBefore root.Before root.Func root.After root.PersistentAfter"},
+		{[]string{"sub"}, "", 0, "root.PersistentBefore sub.PersistentBefore sub.Before sub.Func sub.After sub.PersistentAfter root.PersistentAfter"},
+		{[]string{"sub"}, "sub.PersistentBefore", 3, "root.PersistentBefore sub.PersistentBefore root.PersistentAfter"},
+		{[]string{"sub"}, "sub.Before", 3, "root.PersistentBefore sub.PersistentBefore sub.Before sub.PersistentAfter root.PersistentAfter"},
+		{[]string{"sub"}, "sub.After", 3, "root.PersistentBefore sub.PersistentBefore sub.Before sub.Func sub.After sub.PersistentAfter root.PersistentAfter"},
+	} {
+		calls, abort = nil, test.abort
+		if exitCode := sealeye.RunAdvanced(os.Stdout, os.Stderr, "test", testHook, test.args); exitCode != test.exitCode || strings.Join(calls, " ") != test.calls {
+			t.Fatal(test.args, test.abort, exitCode, calls)
+		}
+	}
+	calls, abort = nil, "panic"
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected panic")
+			}
+		}()
+		sealeye.RunAdvanced(os.Stdout, os.Stderr, "test", testHook, []string{"sub"})
+	}()
+	if strings.Join(calls, " ") != "root.PersistentBefore sub.PersistentBefore sub.Before sub.Func sub.After sub.PersistentAfter root.PersistentAfter" {
+		t.Fatal(calls)
+	}
+}
+
+type testContextCLI struct {
+	Before func(context.Context, *testContextCLI) error
+	Func   func(context.Context, *testContextCLI) error
+}
+
+func TestContext(t *testing.T) {
+	type key struct{}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), key{}, "value"))
+	defer cancel()
+	var before bool
+	testContext := &testContextCLI{
+		Before: func(ctx context.Context, cli *testContextCLI) error {
+			before = ctx.Value(key{}) == "value"
+			return nil
+		},
+		Func: func(ctx context.Context, cli *testContextCLI) error {
+			if ctx.Value(key{}) != "value" {
+				t.Fatal(ctx)
+			}
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}
+	cancel()
+	var stderr bytes.Buffer
+	if exitCode := sealeye.RunAdvancedContext(ctx, os.Stdout, &stderr, "test", testContext, nil); exitCode != sealeye.ExitInterrupted {
+		t.Fatal(exitCode)
+	}
+	if !before || stderr.Len() != 0 {
+		t.Fatal(before, stderr.String())
+	}
+	testContext.Func = func(ctx context.Context, cli *testContextCLI) error {
+		return fmt.Errorf("failed")
+	}
+	if exitCode := sealeye.RunAdvanced(os.Stdout, &stderr, "test", testContext, nil); exitCode != sealeye.ExitFailure {
+		t.Fatal(exitCode)
+	}
+	if stderr.String() != "failed\n" {
+		t.Fatal(stderr.String())
+	}
+}
+
+type testRunInterruptCLI struct {
+	Func func(*testRunInterruptCLI) int
+}
+
+type testRunInterruptContextCLI struct {
+	Func func(context.Context, *testRunInterruptContextCLI) error
+}
+
+// TestRunInterrupt runs itself as a subprocess, as Run calls os.Exit, and
+// interrupts it while a Func is running.
+func TestRunInterrupt(t *testing.T) {
+	switch os.Getenv("TEST_RUN_INTERRUPT") {
+	case "":
+	case "legacy":
+		os.Args = []string{"test"}
+		sealeye.Run(&testRunInterruptCLI{Func: func(cli *testRunInterruptCLI) int {
+			fmt.Println("ready")
+			time.Sleep(5 * time.Second)
+			fmt.Println("finished")
+			return 0
+		}})
+	case "context":
+		os.Args = []string{"test"}
+		sealeye.Run(&testRunInterruptContextCLI{Func: func(ctx context.Context, cli *testRunInterruptContextCLI) error {
+			fmt.Println("ready")
+			select {
+			case <-ctx.Done():
+				fmt.Println("canceled")
+				return ctx.Err()
+			case <-time.After(5 * time.Second):
+			}
+			fmt.Println("finished")
+			return nil
+		}})
+	}
+	if runtime.GOOS == "windows" {
+		t.Skip("cannot send interrupt signals on windows")
+	}
+	for _, test := range []struct {
+		mode   string
+		output string
+	}{
+		{"legacy", "ready\n"},
+		{"context", "ready\ncanceled\n"},
+	} {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestRunInterrupt$")
+		cmd.Env = append(os.Environ(), "TEST_RUN_INTERRUPT="+test.mode)
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		reader := bufio.NewReader(stdout)
+		if line, err := reader.ReadString('\n'); line != "ready\n" {
+			t.Fatal(test.mode, line, err)
+		}
+		if err := cmd.Process.Signal(os.Interrupt); err != nil {
+			t.Fatal(err)
+		}
+		rest, _ := ioutil.ReadAll(reader)
+		cmd.Wait()
+		if output := "ready\n" + string(rest); output != test.output {
+			t.Fatalf("%s %q", test.mode, output)
+		}
+		if exitCode := cmd.ProcessState.ExitCode(); exitCode != sealeye.ExitInterrupted {
+			t.Fatal(test.mode, exitCode)
+		}
+		if elapsed := time.Since(start); elapsed > 4*time.Second {
+			t.Fatal(test.mode, elapsed)
+		}
+	}
+}
+
+type testErrorFuncCLI struct {
+	HelpOption bool `option:"h,help" help:"Outputs this help text."`
+	Func       func(*testErrorFuncCLI) error
+}
+
+func TestErrorFunc(t *testing.T) {
+	for _, test := range []struct {
+		err      error
+		exitCode int
+		stderr   string
+		help     bool
+	}{
+		{nil, sealeye.ExitOK, "", false},
+		{fmt.Errorf("failed"), sealeye.ExitFailure, "failed\n", false},
+		{sealeye.Exit(5, fmt.Errorf("failed")), 5, "failed\n", false},
+		{fmt.Errorf("wrapped: %w", sealeye.Exit(6, fmt.Errorf("failed"))), 6, "wrapped: failed\n", false},
+		{sealeye.Exit(7, nil), 7, "", false},
+		{sealeye.ErrShowHelp, sealeye.ExitFailure, "", true},
+		{sealeye.Exit(sealeye.ExitOK, sealeye.ErrShowHelp), sealeye.ExitOK, "", true},
+		{sealeye.UsageError(fmt.Errorf("bad args")), sealeye.ExitUsage, "bad args\nUsage: test [options]\nTry \"test --help\" for more information.\n", false},
+	} {
+		testErrorFunc := &testErrorFuncCLI{Func: func(cli *testErrorFuncCLI) error {
+			return test.err
+		}}
+		var stdout testHelpWriter
+		var stderr bytes.Buffer
+		if exitCode := sealeye.RunAdvanced(&stdout, &stderr, "test", testErrorFunc, nil); exitCode != test.exitCode {
+			t.Fatal(test.err, exitCode)
+		}
+		if stderr.String() != test.stderr {
+			t.Fatalf("%v %q", test.err, stderr.String())
+		}
+		if help := strings.Contains(stdout.String(), "Options:"); help != test.help {
+			t.Fatal(test.err, stdout.String())
+		}
+	}
+}
+
+type testConfigCLI struct {
+	ConfigOption string        `option:"config" help:"A config file." default:"env:TEST_CONFIG" persistent:"true"`
+	Count        int           `option:"c,count" help:"An int option." default:"env:TEST_CONFIG_COUNT,1"`
+	Name         string        `option:"name" help:"A string option." default:"env:TEST_CONFIG_NAME,config:,x"`
+	Include      []string      `option:"include" help:"A repeatable option."`
+	Delay        time.Duration `option:"delay" help:"A duration option."`
+	Debug        bool          `option:"debug" help:"A bool option."`
+	Input        string        `option:"input" help:"A file option." required:"file"`
+	Func         func(*testConfigCLI) int
+	Subcommands  map[string]interface{}
+}
+
+type testConfigSubcommandCLI struct {
+	Count int `option:"count" help:"An int option." min:"1"`
+	Func  func(*testConfigSubcommandCLI) int
+}
+
+func TestConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	jsonPath := dir + "/config.json"
+	iniPath := dir + "/config.ini"
+	if err := ioutil.WriteFile(jsonPath, []byte(`{"count": 3, "name": "json", "include": ["a", "b"], "delay": "2s", "debug": true, "sub": {"count": 4}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	inputPath := dir + "/input.ini"
+	if err := ioutil.WriteFile(inputPath, []byte("input = missing.txt\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(iniPath, []byte("; A comment.\ncount = 5\nname = \"ini file\"\ninclude = a\ninclude = b\ndelay = 2s\ndebug = true\n\n[sub]\ncount = 0\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var got testConfigCLI
+	var subCount int
+	testConfig := &testConfigCLI{
+		Func: func(cli *testConfigCLI) int {
+			got = *cli
+			return 0
+		},
+		Subcommands: map[string]interface{}{"sub": &testConfigSubcommandCLI{Func: func(cli *testConfigSubcommandCLI) int {
+			subCount = cli.Count
+			return 0
+		}}},
+	}
+	for _, test := range []struct {
+		args    []string
+		env     map[string]string
+		count   int
+		name    string
+		include []string
+		debug   bool
+	}{
+		{nil, nil, 1, "x", nil, false},
+		{[]string{"--config", jsonPath}, nil, 3, "json", []string{"a", "b"}, true},
+		{nil, map[string]string{"TEST_CONFIG": jsonPath}, 3, "json", []string{"a", "b"}, true},
+		{[]string{"--config", jsonPath, "--count", "9"}, map[string]string{"TEST_CONFIG_COUNT": "8", "TEST_CONFIG_NAME": "env"}, 9, "env", []string{"a", "b"}, true},
+		{[]string{"--config", iniPath}, nil, 5, "ini file", []string{"a", "b"}, true},
+	} {
+		for key, value := range test.env {
+			os.Setenv(key, value)
+		}
+		got = testConfigCLI{}
+		exitCode := sealeye.RunAdvanced(os.Stdout, os.Stderr, "test", testConfig, test.args)
+		for key := range test.env {
+			os.Unsetenv(key)
+		}
+		if exitCode != 0 {
+			t.Fatal(test.args, exitCode)
+		}
+		if got.Count != test.count || got.Name != test.name || !reflect.DeepEqual(got.Include, test.include) || got.Debug != test.debug {
+			t.Fatal(test.args, got.Count, got.Name, got.Include, got.Debug)
+		}
+		if test.debug && got.Delay != 2*time.Second {
+			t.Fatal(test.args, got.Delay)
+		}
+	}
+	if exitCode := sealeye.RunAdvanced(os.Stdout, os.Stderr, "test", testConfig, []string{"sub", "--config", jsonPath}); exitCode != 0 || subCount != 4 {
+		t.Fatal(exitCode, subCount)
+	}
+	for _, test := range []struct {
+		args    []string
+		message string
+	}{
+		{[]string{"--config", iniPath, "sub"}, "invalid value \"0\" for option \"--count\" via " + iniPath + ":10 key \"sub.count\"; must be at least 1\n"},
+		{[]string{"--config", inputPath}, "--input \"" + dir + "/missing.txt\" is not a file via " + inputPath + ":1 key \"input\"\n"},
+		{[]string{"--config", dir + "/missing.json"}, "open " + dir + "/missing.json: no such file or directory\n"},
+	} {
+		var stderr bytes.Buffer
+		if exitCode := sealeye.RunAdvanced(os.Stdout, &stderr, "test", testConfig, test.args); exitCode != sealeye.ExitFailure {
+			t.Fatal(test.args, exitCode)
+		}
+		if stderr.String() != test.message {
+			t.Fatalf("%v %q", test.args, stderr.String())
+		}
+	}
+	if err := ioutil.WriteFile(jsonPath, []byte(`{"count": "many"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var stderr bytes.Buffer
+	if exitCode := sealeye.RunAdvanced(os.Stdout, &stderr, "test", testConfig, []string{"--config", jsonPath}); exitCode != sealeye.ExitFailure {
+		t.Fatal(exitCode)
+	}
+	if stderr.String() != "invalid integer \"many\" for option \"-c\" via "+jsonPath+" key \"count\"\n" {
+		t.Fatal(stderr.String())
+	}
+}
+
+type testConfigAfterSubcommandCLI struct {
+	ConfigOption  string `option:"config" help:"A config file." persistent:"true"`
+	ProfileOption string `option:"profile" help:"A config profile." persistent:"true"`
+	Debug         bool   `option:"debug" help:"A bool option."`
+	Name          string `option:"name" help:"A string option." default:"none"`
+	Subcommands   map[string]interface{}
+}
+
+type testConfigAfterSubcommandSubcommandCLI struct {
+	Count int `option:"count" help:"An int option."`
+	Func  func(*testConfigAfterSubcommandSubcommandCLI) int
+}
+
+func TestConfigAfterSubcommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configPath := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(configPath, []byte(`{"debug": true, "sub": {"count": 2}, "profiles": {"staging": {"name": "staging", "sub": {"count": 3}}}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		args  []string
+		name  string
+		count int
+	}{
+		{[]string{"--config", configPath, "sub"}, "none", 2},
+		{[]string{"sub", "--config", configPath}, "none", 2},
+		{[]string{"--config", configPath, "--profile", "staging", "sub"}, "staging", 3},
+		{[]string{"sub", "--config", configPath, "--profile", "staging"}, "staging", 3},
+		{[]string{"--config", configPath, "sub", "--profile", "staging"}, "staging", 3},
+	} {
+		var count int
+		var source string
+		testConfig := &testConfigAfterSubcommandCLI{}
+		testConfig.Subcommands = map[string]interface{}{"sub": &testConfigAfterSubcommandSubcommandCLI{Func: func(cli *testConfigAfterSubcommandSubcommandCLI) int {
+			count = cli.Count
+			source = sealeye.Source(testConfig, "Debug")
+			return 0
+		}}}
+		if exitCode := sealeye.RunAdvanced(os.Stdout, os.Stderr, "test", testConfig, test.args); exitCode != 0 {
+			t.Fatal(test.args, exitCode)
+		}
+		if !testConfig.Debug || testConfig.Name != test.name || count != test.count {
+			t.Fatal(test.args, testConfig.Debug, testConfig.Name, count)
+		}
+		if source != configPath+` key "debug"` {
+			t.Fatal(test.args, source)
+		}
+	}
+}
+
+type testConfigDiscoveryCLI struct {
+	ConfigName   string
+	ConfigOption string   `option:"config" help:"A config file."`
+	Count        int      `option:"c,count" help:"An int option."`
+	Name         string   `option:"name" help:"A string option."`
+	Include      []string `option:"include" help:"A repeatable option."`
+	Header       string   `option:"header" help:"A file option." required:"file"`
+	Func         func(*testConfigDiscoveryCLI) int
+}
+
+func TestConfigDiscovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const configName = "sealeye-test-config-discovery"
+	for path, content := range map[string]string{
+		"project/.sealeye-test-config-discovery.json":  `{"count": 2, "header": "header.txt"}`,
+		"project/header.txt":                           "header",
+		"project/work/deeper/.keep":                    "",
+		".sealeye-test-config-discovery.json":          `{"count": 1, "name": "ignored"}`,
+		"xdg/sealeye-test-config-discovery/config.ini": "c = 5\nname = user\ninclude = u\n",
+		"explicit.json":                                `{"include": ["e"]}`,
+	} {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+	if err := os.Chdir(filepath.Join(dir, "project/work/deeper")); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("XDG_CONFIG_HOME", filepath.Join(dir, "xdg"))
+	defer os.Unsetenv("XDG_CONFIG_HOME")
+	var got testConfigDiscoveryCLI
+	testConfigDiscovery := &testConfigDiscoveryCLI{ConfigName: configName, Func: func(cli *testConfigDiscoveryCLI) int {
+		got = *cli
+		return 0
+	}}
+	for _, test := range []struct {
+		args    []string
+		include []string
+	}{
+		{nil, []string{"u"}},
+		{[]string{"--config", filepath.Join(dir, "explicit.json")}, []string{"e"}},
+	} {
+		if exitCode := sealeye.RunAdvanced(os.Stdout, os.Stderr, "test", testConfigDiscovery, test.args); exitCode != 0 {
+			t.Fatal(test.args, exitCode)
+		}
+		if got.Count != 2 || got.Name != "user" || !reflect.DeepEqual(got.Include, test.include) || got.Header != filepath.Join(dir, "project/header.txt") {
+			t.Fatal(test.args, got.Count, got.Name, got.Include, got.Header)
+		}
+	}
+}
+
+type testProfileCLI struct {
+	HelpOption    bool   `option:"h,help" help:"Outputs this help text."`
+	ConfigOption  string `option:"config" help:"A config file."`
+	ProfileOption string `option:"profile" help:"A config profile." default:"env:TEST_PROFILE"`
+	Count         int    `option:"count" help:"An int option." default:"1"`
+	Name          string `option:"name" help:"A string option."`
+	Host          string `option:"host" help:"A string option."`
+	Func          func(*testProfileCLI) int
+	Subcommands   map[string]interface{}
+}
+
+type testProfileSubcommandCLI struct {
+	Count int `option:"count" help:"An int option."`
+	Func  func(*testProfileSubcommandCLI) int
+}
+
+func TestProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	jsonPath := filepath.Join(dir, "config.json")
+	iniPath := filepath.Join(dir, "config.ini")
+	if err := ioutil.WriteFile(jsonPath, []byte(`{"name": "base", "host": "localhost", "sub": {"count": 10}, "profiles": {"staging": {"host": "staging", "count": 2, "sub": {"count": 20}}, "production": {"inherit": "staging", "host": "production"}, "loop": {"inherit": "loop"}, "orphan": {"inherit": "missing"}}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(iniPath, []byte("name = base\nhost = localhost\n[sub]\ncount = 10\n[profiles.staging]\nhost = staging\ncount = 2\n[profiles.staging.sub]\ncount = 20\n[profiles.production]\ninherit = staging\nhost = production\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var got testProfileCLI
+	var subCount int
+	testProfile := &testProfileCLI{
+		Func: func(cli *testProfileCLI) int {
+			got = *cli
+			return 0
+		},
+		Subcommands: map[string]interface{}{"sub": &testProfileSubcommandCLI{Func: func(cli *testProfileSubcommandCLI) int {
+			subCount = cli.Count
+			return 0
+		}}},
+	}
+	for _, configPath := range []string{jsonPath, iniPath} {
+		for _, test := range []struct {
+			args     []string
+			env      string
+			count    int
+			host     string
+			subCount int
+		}{
+			{nil, "", 1, "localhost", 10},
+			{[]string{"--profile", "staging"}, "", 2, "staging", 20},
+			{nil, "production", 2, "production", 20},
+			{[]string{"--profile", "production", "--host", "given"}, "", 2, "given", 20},
+		} {
+			os.Setenv("TEST_PROFILE", test.env)
+			args := append([]string{"--config", configPath}, test.args...)
+			exitCode := sealeye.RunAdvanced(os.Stdout, os.Stderr, "test", testProfile, args)
+			if exitCode != 0 || got.Count != test.count || got.Host != test.host || got.Name != "base" {
+				t.Fatal(args, test.env, exitCode, got.Count, got.Host, got.Name)
+			}
+			if exitCode := sealeye.RunAdvanced(os.Stdout, os.Stderr, "test", testProfile, append(args, "sub")); exitCode != 0 || subCount != test.subCount {
+				t.Fatal(args, test.env, exitCode, subCount)
+			}
+		}
+	}
+	os.Unsetenv("TEST_PROFILE")
+	for _, test := range []struct {
+		profile string
+		message string
+	}{
+		{"nope", "unknown profile \"nope\"\n"},
+		{"loop", "profile \"loop\" inherits from itself\n"},
+		{"orphan", "unknown profile \"missing\" inherited by profile \"orphan\"\n"},
+	} {
+		var stderr bytes.Buffer
+		if exitCode := sealeye.RunAdvanced(os.Stdout, &stderr, "test", testProfile, []string{"--config", jsonPath, "--profile", test.profile}); exitCode != sealeye.ExitFailure {
+			t.Fatal(test.profile, exitCode)
+		}
+		if stderr.String() != test.message {
+			t.Fatalf("%s %q", test.profile, stderr.String())
+		}
+	}
+	var stdout testHelpWriter
+	if exitCode := sealeye.RunAdvanced(&stdout, os.Stderr, "test", testProfile, []string{"--config", jsonPath, "--profile", "staging", "--help"}); exitCode != 0 {
+		t.Fatal(exitCode)
+	}
+	if !strings.Contains(stdout.String(), "Active profile: staging") {
+		t.Fatal(stdout.String())
+	}
+}
+
+type testSourceCLI struct {
+	ConfigOption  string   `option:"config" help:"A config file."`
+	ExplainOption bool     `option:"explain-options" help:"Explain the options." persistent:"true"`
+	Count         int      `option:"c,count" help:"An int option." default:"env:TEST_SOURCE_COUNT,1"`
+	Name          string   `option:"name" help:"A string option."`
+	Color         bool     `option:"color" help:"A bool option." default:"terminal"`
+	Debug         bool     `option:"d,debug" help:"A persistent option." persistent:"true"`
+	Secret        string   `option:"secret" help:"A hidden option." hidden:"true"`
+	Args          []string `arg:"rest"`
+	Func          func(*testSourceCLI) int
+	Subcommands   map[string]interface{}
+}
+
+type testSourceSubcommandCLI struct {
+	Debug bool
+	Path  string `arg:"0" name:"PATH"`
+	Func  func(*testSourceSubcommandCLI) int
+}
+
+func TestSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	iniPath := filepath.Join(dir, "config.ini")
+	if err := ioutil.WriteFile(iniPath, []byte("; comment\nname = from config\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Sources are only kept while running, so the Funcs look up the source
+	// of the current test's field.
+	ran := false
+	var command interface{}
+	var field, source string
+	testSubcommand := &testSourceSubcommandCLI{Func: func(cli *testSourceSubcommandCLI) int {
+		ran = true
+		source = sealeye.Source(command, field)
+		return 0
+	}}
+	testSource := &testSourceCLI{
+		Func: func(cli *testSourceCLI) int {
+			ran = true
+			source = sealeye.Source(command, field)
+			return 0
+		},
+		Subcommands: map[string]interface{}{"sub": testSubcommand},
+	}
+	for _, test := range []struct {
+		args    []string
+		env     string
+		command interface{}
+		field   string
+		source  string
+	}{
+		{nil, "", testSource, "Count", "default"},
+		{nil, "3", testSource, "Count", "$TEST_SOURCE_COUNT"},
+		{[]string{"-c", "5"}, "3", testSource, "Count", "command line argument 1"},
+		{[]string{"--debug", "--count=5"}, "", testSource, "Count", "command line argument 2"},
+		{[]string{"-dc5"}, "", testSource, "Debug", "command line argument 1"},
+		{nil, "", testSource, "Color", "terminal"},
+		{nil, "", testSource, "Name", ""},
+		{[]string{"--config", iniPath}, "", testSource, "Name", iniPath + ":2 key \"name\""},
+		{[]string{"a", "b"}, "", testSource, "Args", "command line argument 2"},
+		{[]string{"sub", "x"}, "", testSubcommand, "Path", "command line argument 2"},
+		{[]string{"-c", "5", "sub", "x", "--debug"}, "", testSubcommand, "Debug", "command line argument 5"},
+		{[]string{"-c", "5", "sub", "x", "--debug"}, "", testSource, "Debug", "command line argument 5"},
+		{[]string{"sub", "x"}, "", testSubcommand, "Debug", ""},
+	} {
+		os.Setenv("TEST_SOURCE_COUNT", test.env)
+		if test.env == "" {
+			os.Unsetenv("TEST_SOURCE_COUNT")
+		}
+		ran = false
+		command, field = test.command, test.field
+		if exitCode := sealeye.RunAdvanced(os.Stdout, os.Stderr, "test", testSource, test.args); exitCode != 0 || !ran {
+			t.Fatal(test.args, exitCode, ran)
+		}
+		if source != test.source {
+			t.Fatalf("%v %s %q", test.args, test.field, source)
+		}
+		if source := sealeye.Source(test.command, test.field); source != "" {
+			t.Fatalf("%v %s %q after running", test.args, test.field, source)
+		}
+	}
+	os.Unsetenv("TEST_SOURCE_COUNT")
+	for _, test := range []struct {
+		args     []string
+		contains []string
+		excludes []string
+	}{
+		{[]string{"--config", iniPath, "-c", "5", "--explain-options"}, []string{"\n--count 5 command line argument 3\n", "\n--name from config " + iniPath + ":2 key \"name\"\n", "\n--color false terminal\n", "\nARGS"}, []string{"--secret", "--explain-options"}},
+		{[]string{"--debug", "sub", "--explain-options"}, []string{"\nPATH", "\n--debug true command line argument 1\n"}, []string{"\n--count "}},
+	} {
+		var stdout testHelpWriter
+		ran = false
+		if exitCode := sealeye.RunAdvanced(&stdout, os.Stderr, "test", testSource, test.args); exitCode != 0 || ran {
+			t.Fatal(test.args, exitCode, ran)
+		}
+		// Compare with the table's columns separated by single spaces.
+		var lines []string
+		for _, line := range strings.Split(stdout.String(), "\n") {
+			lines = append(lines, strings.Join(strings.Fields(line), " "))
+		}
+		table := strings.Join(lines, "\n")
+		for _, s := range test.contains {
+			if !strings.Contains(table, s) {
+				t.Fatalf("%v %q not in %q", test.args, s, table)
+			}
+		}
+		for _, s := range test.excludes {
+			if strings.Contains(table, s) {
+				t.Fatalf("%v %q in %q", test.args, s, table)
+			}
+		}
+	}
+}
+
+type testDumpConfigCLI struct {
+	ConfigOption     string        `option:"config" help:"A config file."`
+	DumpConfigOption string        `option:"dump-config" help:"Dump the config." persistent:"true"`
+	Count            int           `option:"c,count" help:"An int option." default:"1"`
+	Ratio            float64       `option:"ratio" help:"A float option."`
+	Debug            bool          `option:"d,debug" help:"A persistent option." persistent:"true"`
+	Name             string        `option:"name" help:"A string option." default:"config:title"`
+	Delay            time.Duration `option:"delay" help:"A duration option." default:"1s"`
+	Include          []string      `option:"include" help:"A slice option."`
+	Limit            *int          `option:"limit" help:"A pointer option."`
+	Password         string        `option:"password" help:"A secret option." secret:"true"`
+	Internal         string        `option:"internal" help:"A hidden option." hidden:"true"`
+	Func             func(*testDumpConfigCLI) int
+	Subcommands      map[string]interface{}
+}
+
+type testDumpConfigSubcommandCLI struct {
+	Count int    `option:"count" help:"An int option."`
+	File  string `option:"file" help:"A file option." required:"file"`
+	Func  func(*testDumpConfigSubcommandCLI) int
+}
+
+func TestDumpConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "file.txt"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	var gotSub testDumpConfigSubcommandCLI
+	newCommand := func() *testDumpConfigCLI {
+		return &testDumpConfigCLI{
+			Subcommands: map[string]interface{}{"sub": &testDumpConfigSubcommandCLI{Func: func(cli *testDumpConfigSubcommandCLI) int {
+				gotSub = *cli
+				return 0
+			}}},
+		}
+	}
+	args := []string{"-c", "3", "--ratio", "0.5", "--name", "a \"name\" ", "--delay", "2m", "--include", "x", "--include", "y", "--password", "hunter2", "--internal", "i", "sub", "--count", "4", "--file", "file.txt", "--debug"}
+	for _, format := range []string{"json", "ini"} {
+		var stdout testHelpWriter
+		if exitCode := sealeye.RunAdvanced(&stdout, os.Stderr, "test", newCommand(), append(args, "--dump-config", format)); exitCode != 0 {
+			t.Fatal(format, exitCode)
+		}
+		for _, s := range []string{"hunter2", "password", "internal", "limit", "dump-config"} {
+			if strings.Contains(stdout.String(), s) {
+				t.Fatalf("%s %q in %q", format, s, stdout.String())
+			}
+		}
+		configPath := filepath.Join(dir, "config."+format)
+		if err := ioutil.WriteFile(configPath, stdout.Bytes(), 0600); err != nil {
+			t.Fatal(err)
+		}
+		// The root's Func isn't called for the subcommand, but its options
+		// are still set from the config file.
+		command := newCommand()
+		gotSub = testDumpConfigSubcommandCLI{}
+		if exitCode := sealeye.RunAdvanced(os.Stdout, os.Stderr, "test", command, []string{"--config", configPath, "sub"}); exitCode != 0 {
+			t.Fatalf("%s %d %q", format, exitCode, stdout.String())
+		}
+		got := *command
+		if got.Count != 3 || got.Ratio != 0.5 || !got.Debug || got.Name != "a \"name\" " || got.Delay != 2*time.Minute || !reflect.DeepEqual(got.Include, []string{"x", "y"}) || got.Limit != nil || got.Password != "" || got.Internal != "" {
+			t.Fatalf("%s %#v %q", format, got, stdout.String())
+		}
+		if gotSub.Count != 4 || gotSub.File != filepath.Join(dir, "file.txt") {
+			t.Fatalf("%s %#v %q", format, gotSub, stdout.String())
+		}
+	}
+	var stdout testHelpWriter
+	if exitCode := sealeye.RunAdvanced(&stdout, os.Stderr, "test", newCommand(), []string{"--name", "n", "--dump-config", "json"}); exitCode != 0 {
+		t.Fatal(exitCode)
+	}
+	if !strings.Contains(stdout.String(), `"title": "n"`) || strings.Contains(stdout.String(), "sub") {
+		t.Fatal(stdout.String())
+	}
+	var stderr bytes.Buffer
+	if exitCode := sealeye.RunAdvanced(&stdout, &stderr, "test", newCommand(), []string{"--dump-config", "yaml"}); exitCode != sealeye.ExitUsage || !strings.HasPrefix(stderr.String(), "unknown config format \"yaml\"") {
+		t.Fatal(exitCode, stderr.String())
+	}
+}